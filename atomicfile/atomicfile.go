@@ -0,0 +1,50 @@
+package atomicfile
+
+import (
+    "io"
+    "os"
+    "io/ioutil"
+    "path/filepath"
+)
+
+// Write replaces the file at fpath with what write writes. The data is
+// written to a temp file in the same directory first, which is renamed
+// over fpath, so a crash never leaves a torn file.
+func Write(fpath string, write func(io.Writer) error) error {
+    dir, fname := filepath.Split(fpath)
+
+    f, err := ioutil.TempFile(dir, "." + fname)
+    if err != nil {
+        return err
+    }
+
+    // Close temp file on function exit if its not already closed
+    defer f.Close()
+
+    if err := write(f); err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    if err := f.Close(); err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    // Overwrite the old file with the new one,
+    // which is an atomic operation on sane OS's
+    if err := os.Rename(f.Name(), fpath); err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    return nil
+}
+
+// WriteData replaces the file at fpath with data like Write
+func WriteData(fpath string, data []byte) error {
+    return Write(fpath, func(w io.Writer) error {
+        _, err := w.Write(data)
+        return err
+    })
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+    "os"
+    "sync"
+    "time"
+    "bufio"
+    "reflect"
+    "encoding/json"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/log"
+)
+
+const (
+    AuditFname = "audit.log"
+)
+
+type Entry struct {
+    Time string `json:"time"`
+    Actor string `json:"actor"`
+    Action image.Action `json:"action"`
+    Uuid string `json:"uuid"`
+    Diff map[string]*FieldDiff `json:"diff"`
+}
+
+// FieldDiff holds the value of a manifest field before and after a change,
+// a nil value means that the field was not present
+type FieldDiff struct {
+    Before interface{} `json:"before"`
+    After interface{} `json:"after"`
+}
+
+// Log is an append-only log of all changes made to the catalog,
+// stored as one json entry per line
+type Log struct {
+    fpath string
+    file *os.File
+    logger *log.Logger
+    mutex *sync.Mutex
+}
+
+func Open(fpath string, logger *log.Logger) (*Log, error) {
+    f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+    if err != nil {
+        return nil, err
+    }
+
+    return &Log{fpath, f, logger, &sync.Mutex{}}, nil
+}
+
+// Record is an image.Listener which appends the change to the log
+func (self *Log) Record(change *image.Change) {
+    entry := &Entry{
+        Time: change.Time.UTC().Format(time.RFC3339Nano),
+        Actor: change.Actor,
+        Action: change.Action,
+        Uuid: change.Uuid,
+        Diff: diff(change.Before, change.After),
+    }
+
+    if err := self.append(entry); err != nil {
+        self.logger.Errorf("Failed to write audit log entry for %s %s: %s", entry.Action, entry.Uuid, err)
+    }
+}
+
+func (self *Log) append(entry *Entry) error {
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    // Write the entry in one go so entries are never interleaved
+    if _, err := self.file.Write(append(data, '\n')); err != nil {
+        return err
+    }
+    return self.file.Sync()
+}
+
+// Query returns all entries for the image with the given uuid,
+// or all entries if uuid is empty
+func (self *Log) Query(uuid string) ([]*Entry, error) {
+    f, err := os.Open(self.fpath)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    entries := make([]*Entry, 0)
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+    for scanner.Scan() {
+        entry := &Entry{}
+        if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+            return nil, err
+        }
+
+        if uuid == "" || entry.Uuid == uuid {
+            entries = append(entries, entry)
+        }
+    }
+
+    return entries, scanner.Err()
+}
+
+func (self *Log) Close() error {
+    return self.file.Close()
+}
+
+// diff returns the manifest fields that differ between before and after
+func diff(before, after *image.Manifest) map[string]*FieldDiff {
+    beforeFields := fields(before)
+    afterFields := fields(after)
+
+    diffs := make(map[string]*FieldDiff)
+
+    for key, value := range beforeFields {
+        if !reflect.DeepEqual(value, afterFields[key]) {
+            diffs[key] = &FieldDiff{value, afterFields[key]}
+        }
+    }
+
+    for key, value := range afterFields {
+        if _, ok := beforeFields[key]; !ok {
+            diffs[key] = &FieldDiff{nil, value}
+        }
+    }
+
+    return diffs
+}
+
+func fields(m *image.Manifest) map[string]interface{} {
+    fields := make(map[string]interface{})
+    if m == nil {
+        return fields
+    }
+
+    data, _ := json.Marshal(m)
+    json.Unmarshal(data, &fields)
+    return fields
+}
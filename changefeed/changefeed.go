@@ -0,0 +1,249 @@
+package changefeed
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "io"
+    "bufio"
+    "path/filepath"
+    "encoding/json"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/atomicfile"
+    "github.com/prasmussen/smartimages/log"
+)
+
+const (
+    ChangefeedFname = "changefeed.log"
+)
+
+var ErrCursorExpired = fmt.Errorf("Changes since the given sequence are no longer retained")
+
+// Entry is a change of the catalog. Image holds the manifest after the
+// change and is nil if the image was purged.
+type Entry struct {
+    Seq uint64 `json:"seq"`
+    Action image.Action `json:"action"`
+    Uuid string `json:"uuid"`
+    Time string `json:"time"`
+    Image *image.Manifest `json:"image"`
+}
+
+// Feed keeps the latest changes of the catalog with increasing sequence
+// numbers. The changes are persisted so that the sequence numbers
+// continue where they left off after a restart.
+type Feed struct {
+    fpath string
+    file *os.File
+    retention int
+    fileEntries int
+    entries []*Entry
+    seq uint64
+    changed chan struct{}
+    stopped chan struct{}
+    isStopped bool
+    logger *log.Logger
+    mutex *sync.Mutex
+}
+
+// Open loads the changefeed stored in dataDir, at most
+// retention changes are kept available to readers
+func Open(dataDir string, retention int, logger *log.Logger) (*Feed, error) {
+    fpath := filepath.Join(dataDir, ChangefeedFname)
+
+    entries, fileEntries, err := loadEntries(fpath, retention)
+    if err != nil {
+        return nil, err
+    }
+
+    f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+    if err != nil {
+        return nil, err
+    }
+
+    feed := &Feed{
+        fpath: fpath,
+        file: f,
+        retention: retention,
+        fileEntries: fileEntries,
+        entries: entries,
+        changed: make(chan struct{}),
+        stopped: make(chan struct{}),
+        logger: logger,
+        mutex: &sync.Mutex{},
+    }
+
+    if len(entries) > 0 {
+        feed.seq = entries[len(entries) - 1].Seq
+    }
+
+    return feed, nil
+}
+
+func loadEntries(fpath string, retention int) ([]*Entry, int, error) {
+    entries := make([]*Entry, 0)
+
+    f, err := os.Open(fpath)
+    if os.IsNotExist(err) {
+        return entries, 0, nil
+    } else if err != nil {
+        return nil, 0, err
+    }
+    defer f.Close()
+
+    count := 0
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+    for scanner.Scan() {
+        entry := &Entry{}
+        if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+            return nil, 0, fmt.Errorf("Failed to parse %s: %s", fpath, err)
+        }
+
+        entries = append(entries, entry)
+        count++
+
+        if len(entries) > retention {
+            entries = entries[1:]
+        }
+    }
+
+    return entries, count, scanner.Err()
+}
+
+// Record is an image.Listener which appends the change to the feed
+func (self *Feed) Record(change *image.Change) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.seq++
+    entry := &Entry{
+        Seq: self.seq,
+        Action: change.Action,
+        Uuid: change.Uuid,
+        Time: change.Time.UTC().Format(time.RFC3339Nano),
+        Image: change.After,
+    }
+
+    if err := self.append(entry); err != nil {
+        self.logger.Errorf("Failed to write changefeed entry %d: %s", entry.Seq, err)
+    }
+
+    self.entries = append(self.entries, entry)
+    if len(self.entries) > self.retention {
+        self.entries = self.entries[1:]
+    }
+
+    // Wake up everyone waiting for changes
+    close(self.changed)
+    self.changed = make(chan struct{})
+}
+
+// append writes the entry to the feed file, the caller must hold the lock
+func (self *Feed) append(entry *Entry) error {
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+
+    if _, err := self.file.Write(append(data, '\n')); err != nil {
+        return err
+    }
+    self.fileEntries++
+
+    // Compact the file when it holds twice the retained entries
+    if self.fileEntries > 2 * self.retention {
+        return self.compact()
+    }
+
+    return nil
+}
+
+// compact rewrites the feed file with only the retained entries,
+// the caller must hold the lock
+func (self *Feed) compact() error {
+    err := atomicfile.Write(self.fpath, func(w io.Writer) error {
+        encoder := json.NewEncoder(w)
+        for _, entry := range self.entries {
+            if err := encoder.Encode(entry); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    // Continue appending to the compacted file
+    file, err := os.OpenFile(self.fpath, os.O_WRONLY|os.O_APPEND, 0660)
+    if err != nil {
+        return err
+    }
+
+    self.file.Close()
+    self.file = file
+    self.fileEntries = len(self.entries)
+    return nil
+}
+
+// Seq returns the sequence number of the latest change
+func (self *Feed) Seq() uint64 {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.seq
+}
+
+// Since returns the changes after the given sequence number and a channel
+// which is closed when more changes are available. ErrCursorExpired is
+// returned if some of the changes after seq are no longer retained.
+func (self *Feed) Since(seq uint64) ([]*Entry, <-chan struct{}, error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if seq > self.seq {
+        return nil, nil, ErrCursorExpired
+    }
+
+    if seq < self.seq && (len(self.entries) == 0 || self.entries[0].Seq > seq + 1) {
+        return nil, nil, ErrCursorExpired
+    }
+
+    entries := make([]*Entry, 0)
+    for _, entry := range self.entries {
+        if entry.Seq > seq {
+            entries = append(entries, entry)
+        }
+    }
+
+    return entries, self.changed, nil
+}
+
+// Stopped returns a channel which is closed when the streams are stopped
+func (self *Feed) Stopped() <-chan struct{} {
+    return self.stopped
+}
+
+// StopStreams ends all streams waiting for changes,
+// changes are still recorded until the feed is closed
+func (self *Feed) StopStreams() {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if !self.isStopped {
+        self.isStopped = true
+        close(self.stopped)
+    }
+}
+
+func (self *Feed) Close() {
+    self.StopStreams()
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.file.Close()
+}
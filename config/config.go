@@ -2,32 +2,448 @@ package config
 
 import (
     "os"
+    "fmt"
+    "net"
+    "net/url"
+    "strings"
+    "strconv"
+    "io/ioutil"
+    "path/filepath"
+    "crypto/tls"
+    "crypto/x509"
+    "github.com/prasmussen/smartimages/gc"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/log"
+    "github.com/prasmussen/smartimages/mirror"
+    "github.com/prasmussen/smartimages/recompress"
+    "github.com/prasmussen/smartimages/webhook"
     "encoding/json"
 )
 
 const (
     DefaultConfig = "config.json"
+    EnvPrefix = "SMARTIMAGES_"
 )
 
 type Config struct {
     Listen string
     LogFile string
+    LogSink string
+    LogLevel string
+    LogFormat string
+    LogMaxSize int
+    LogMaxFiles int
+    SyslogAddr string
+    DataDir string
+    ShutdownTimeout int
+    ChangefeedRetention int
+    TLSCert string
+    TLSKey string
+    ClientCA string
+    Operators map[string]string
+    Webhooks []webhook.Hook
+    Mirrors []mirror.Upstream
+    ProxyUpstream string
+    CacheSize int
+    Primary string
+    ScrubInterval int
+    GCInterval int
+    GCMaxAge int
+    GCDelete bool
+    TrashRetention int
+    Recompress []string
+
+    // Deprecated, only read to point to the migration
     ImageDir string
 }
 
-func Load() (*Config, error) {
+func Defaults() *Config {
+    return &Config{
+        Listen: ":8080",
+        LogFile: "request.log",
+        LogSink: "file",
+        LogLevel: "debug",
+        LogFormat: "json",
+        LogMaxSize: 100,
+        LogMaxFiles: 5,
+        DataDir: "data",
+        ShutdownTimeout: 30,
+        ChangefeedRetention: 10000,
+        ScrubInterval: 86400,
+        GCInterval: 86400,
+        GCMaxAge: 1209600,
+        TrashRetention: 604800,
+        Operators: map[string]string{},
+        Webhooks: []webhook.Hook{},
+        Mirrors: []mirror.Upstream{},
+        Recompress: []string{},
+    }
+}
+
+// Load reads the config file at fname on top of the default values and
+// applies any environment overrides. A missing default config file is not
+// an error, an explicitly given one is.
+func Load(fname string) (*Config, error) {
+    cfg := Defaults()
+
+    if fname == "" {
+        fname = DefaultConfig
+    }
+
+    if err := cfg.readFile(fname); err != nil {
+        if !(os.IsNotExist(err) && fname == DefaultConfig) {
+            return nil, err
+        }
+    }
+
+    if err := cfg.applyEnv(); err != nil {
+        return nil, err
+    }
+
+    // Starting with an empty data dir would silently lose the catalog
+    if cfg.ImageDir != "" {
+        return nil, fmt.Errorf("%s: imagedir is no longer supported, move %s into %s and %s into %s, then replace imagedir with datadir", fname, image.ManifestsFname, filepath.Join(cfg.DataDir, image.ManifestsFname), cfg.ImageDir, filepath.Join(cfg.DataDir, image.ImageDirName))
+    }
+
+    // Invalid values would otherwise only fail once they are used
+    if err := cfg.Validate(); err != nil {
+        return nil, err
+    }
+
+    return cfg, nil
+}
+
+// Reload loads the config file at fname again. Settings that can't be
+// changed without a restart keep their current value, the names of the
+// ones that were changed in the file are returned. An invalid config
+// is rejected as a whole.
+func (self *Config) Reload(fname string) (*Config, []string, error) {
+    cfg, err := Load(fname)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    ignored := make([]string, 0)
+
+    if cfg.Listen != self.Listen {
+        cfg.Listen = self.Listen
+        ignored = append(ignored, "listen")
+    }
+
+    if cfg.DataDir != self.DataDir {
+        cfg.DataDir = self.DataDir
+        ignored = append(ignored, "datadir")
+    }
+
+    if cfg.TLSCert != self.TLSCert || cfg.TLSKey != self.TLSKey || cfg.ClientCA != self.ClientCA {
+        cfg.TLSCert = self.TLSCert
+        cfg.TLSKey = self.TLSKey
+        cfg.ClientCA = self.ClientCA
+        ignored = append(ignored, "tlscert/tlskey/clientca")
+    }
+
+    if cfg.ProxyUpstream != self.ProxyUpstream || cfg.CacheSize != self.CacheSize {
+        cfg.ProxyUpstream = self.ProxyUpstream
+        cfg.CacheSize = self.CacheSize
+        ignored = append(ignored, "proxyupstream/cachesize")
+    }
+
+    if cfg.Primary != self.Primary {
+        cfg.Primary = self.Primary
+        ignored = append(ignored, "primary")
+    }
+
+    return cfg, ignored, nil
+}
+
+func (self *Config) readFile(fname string) error {
     // Open config for reading
-    f, err := os.Open(DefaultConfig)
+    f, err := os.Open(fname)
     if err != nil {
-        return nil, err
+        return err
     }
     defer f.Close()
 
-    // Unmarshal config data
-    cfg := &Config{}
-    if err := json.NewDecoder(f).Decode(cfg); err != nil {
+    // Unmarshal config data, typo'd keys should not be silently ignored
+    decoder := json.NewDecoder(f)
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(self); err != nil {
+        return fmt.Errorf("%s: %s", fname, err)
+    }
+
+    return nil
+}
+
+func (self *Config) applyEnv() error {
+    overrides := map[string]interface{}{
+        "LISTEN": &self.Listen,
+        "LOGFILE": &self.LogFile,
+        "LOGSINK": &self.LogSink,
+        "LOGLEVEL": &self.LogLevel,
+        "LOGFORMAT": &self.LogFormat,
+        "LOGMAXSIZE": &self.LogMaxSize,
+        "LOGMAXFILES": &self.LogMaxFiles,
+        "SYSLOGADDR": &self.SyslogAddr,
+        "DATADIR": &self.DataDir,
+        "SHUTDOWNTIMEOUT": &self.ShutdownTimeout,
+        "CHANGEFEEDRETENTION": &self.ChangefeedRetention,
+        "TLSCERT": &self.TLSCert,
+        "TLSKEY": &self.TLSKey,
+        "CLIENTCA": &self.ClientCA,
+        "PROXYUPSTREAM": &self.ProxyUpstream,
+        "CACHESIZE": &self.CacheSize,
+        "PRIMARY": &self.Primary,
+        "SCRUBINTERVAL": &self.ScrubInterval,
+        "GCINTERVAL": &self.GCInterval,
+        "GCMAXAGE": &self.GCMaxAge,
+        "GCDELETE": &self.GCDelete,
+        "TRASHRETENTION": &self.TrashRetention,
+    }
+
+    for name, field := range overrides {
+        value, ok := os.LookupEnv(EnvPrefix + name)
+        if !ok {
+            continue
+        }
+
+        switch field := field.(type) {
+        case *string:
+            *field = value
+        case *int:
+            n, err := strconv.Atoi(value)
+            if err != nil {
+                return fmt.Errorf("%s%s: %s", EnvPrefix, name, err)
+            }
+            *field = n
+        case *bool:
+            b, err := strconv.ParseBool(value)
+            if err != nil {
+                return fmt.Errorf("%s%s: %s", EnvPrefix, name, err)
+            }
+            *field = b
+        }
+    }
+
+    return nil
+}
+
+// Validate checks the config values without touching the filesystem,
+// all problems found are returned in a single error
+func (self *Config) Validate() error {
+    return problemsError(self.problems())
+}
+
+// Check validates the config values and makes sure that all paths
+// are writable. All problems found are returned in a single error.
+func (self *Config) Check() error {
+    problems := self.problems()
+
+    // An empty logfile means logging to stdout
+    if self.LogFile != "" && (self.LogSink == "file" || self.LogSink == "rotate") {
+        if err := checkFileWritable(self.LogFile); err != nil {
+            problems = append(problems, fmt.Sprintf("logfile: %s", err))
+        }
+    }
+
+    if self.DataDir != "" {
+        if err := checkDirWritable(self.DataDir); err != nil {
+            problems = append(problems, fmt.Sprintf("datadir: %s", err))
+        }
+    }
+
+    return problemsError(problems)
+}
+
+func problemsError(problems []string) error {
+    if len(problems) > 0 {
+        return fmt.Errorf("Invalid config:\n  %s", strings.Join(problems, "\n  "))
+    }
+    return nil
+}
+
+// problems returns the problems with the config values
+func (self *Config) problems() []string {
+    problems := make([]string, 0)
+
+    if _, _, err := net.SplitHostPort(self.Listen); err != nil {
+        problems = append(problems, fmt.Sprintf("listen: %s", err))
+    }
+
+    if err := self.LogOptions().Validate(); err != nil {
+        problems = append(problems, fmt.Sprintf("log: %s", err))
+    }
+
+    if self.ShutdownTimeout < 0 {
+        problems = append(problems, "shutdowntimeout: must not be negative")
+    }
+
+    if self.ChangefeedRetention <= 0 {
+        problems = append(problems, "changefeedretention: must be positive")
+    }
+
+    if self.ScrubInterval < 0 {
+        problems = append(problems, "scrubinterval: must not be negative")
+    }
+
+    if self.GCInterval < 0 {
+        problems = append(problems, "gcinterval: must not be negative")
+    }
+
+    if self.GCMaxAge < 0 {
+        problems = append(problems, "gcmaxage: must not be negative")
+    }
+
+    if self.TrashRetention < 0 {
+        problems = append(problems, "trashretention: must not be negative")
+    }
+
+    if self.DataDir == "" {
+        problems = append(problems, "datadir: must not be empty")
+    }
+
+    for i, hook := range self.Webhooks {
+        if u, err := url.Parse(hook.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+            problems = append(problems, fmt.Sprintf("webhooks[%d]: invalid url: %s", i, hook.Url))
+        }
+    }
+
+    for i, upstream := range self.Mirrors {
+        if err := upstream.Validate(); err != nil {
+            problems = append(problems, fmt.Sprintf("mirrors[%d]: %s", i, err))
+        }
+    }
+
+    if self.ProxyUpstream != "" {
+        if u, err := url.Parse(self.ProxyUpstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+            problems = append(problems, fmt.Sprintf("proxyupstream: invalid url: %s", self.ProxyUpstream))
+        }
+    }
+
+    if self.CacheSize < 0 {
+        problems = append(problems, "cachesize: must not be negative")
+    }
+
+    for i, format := range self.Recompress {
+        if !recompress.Formats[format] {
+            problems = append(problems, fmt.Sprintf("recompress[%d]: unsupported compression: %s", i, format))
+        }
+    }
+
+    if self.Primary != "" {
+        if u, err := url.Parse(self.Primary); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+            problems = append(problems, fmt.Sprintf("primary: invalid url: %s", self.Primary))
+        }
+
+        // Images added by the proxy would be overwritten by the primary
+        if self.ProxyUpstream != "" {
+            problems = append(problems, "primary: can't be combined with proxyupstream")
+        }
+    }
+
+    if _, err := self.TLSConfig(); err != nil {
+        problems = append(problems, fmt.Sprintf("tls: %s", err))
+    }
+
+    return problems
+}
+
+// LogOptions returns the options for the request logger,
+// the max log size is given in megabytes in the config
+func (self *Config) LogOptions() log.Options {
+    return log.Options{
+        Sink: self.LogSink,
+        File: self.LogFile,
+        Level: self.LogLevel,
+        Format: self.LogFormat,
+        MaxSize: int64(self.LogMaxSize) * 1024 * 1024,
+        MaxFiles: self.LogMaxFiles,
+        SyslogAddr: self.SyslogAddr,
+    }
+}
+
+// GCOptions returns the options for the scheduled garbage collection
+func (self *Config) GCOptions() gc.Options {
+    return gc.Options{
+        Interval: self.GCInterval,
+        MaxAge: self.GCMaxAge,
+        Delete: self.GCDelete,
+    }
+}
+
+// CacheSizeBytes returns the max size of the proxy cache,
+// which is given in megabytes in the config
+func (self *Config) CacheSizeBytes() int64 {
+    return int64(self.CacheSize) * 1024 * 1024
+}
+
+// UseTLS returns true if the server should serve https
+func (self *Config) UseTLS() bool {
+    return self.TLSCert != "" || self.TLSKey != ""
+}
+
+// TLSConfig returns the tls config for the listener or nil if TLS is not
+// enabled. If a client CA is given, client certificates signed by it are
+// verified and can be mapped to an operator identity.
+func (self *Config) TLSConfig() (*tls.Config, error) {
+    if !self.UseTLS() {
+        if self.ClientCA != "" {
+            return nil, fmt.Errorf("clientca requires tlscert and tlskey")
+        }
+        return nil, nil
+    }
+
+    cert, err := tls.LoadX509KeyPair(self.TLSCert, self.TLSKey)
+    if err != nil {
         return nil, err
     }
 
-    return cfg, nil
+    tlsConfig := &tls.Config{
+        Certificates: []tls.Certificate{cert},
+    }
+
+    if self.ClientCA == "" {
+        return tlsConfig, nil
+    }
+
+    pem, err := ioutil.ReadFile(self.ClientCA)
+    if err != nil {
+        return nil, err
+    }
+
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+        return nil, fmt.Errorf("%s: no certificates found", self.ClientCA)
+    }
+
+    // Client certificates are optional for the read-only endpoints,
+    // the mutating endpoints check for an operator identity themselves
+    tlsConfig.ClientCAs = pool
+    tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+    return tlsConfig, nil
+}
+
+func checkFileWritable(fname string) error {
+    // Open the file the same way the logger does, without truncating it
+    f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+    if err != nil {
+        return err
+    }
+    return f.Close()
+}
+
+func checkDirWritable(dir string) error {
+    // Create directory if it does not exist
+    if err := os.MkdirAll(dir, 0775); err != nil {
+        return err
+    }
+
+    // Make sure we are able to create files in the directory
+    f, err := ioutil.TempFile(dir, ".check")
+    if err != nil {
+        return err
+    }
+    f.Close()
+
+    return os.Remove(f.Name())
 }
@@ -0,0 +1,91 @@
+package config
+
+import (
+    "os"
+    "testing"
+    "io/ioutil"
+)
+
+// writeConfig writes data to a temp config file and returns its name
+func writeConfig(t *testing.T, data string) string {
+    f, err := ioutil.TempFile("", "smartimages")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    if _, err := f.WriteString(data); err != nil {
+        t.Fatal(err)
+    }
+    return f.Name()
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+    fname := writeConfig(t, `{"listen": ":9000", "scrubinterval": 60, "gcdelete": false}`)
+    defer os.Remove(fname)
+
+    os.Setenv(EnvPrefix + "LISTEN", ":9090")
+    os.Setenv(EnvPrefix + "GCDELETE", "true")
+    defer os.Unsetenv(EnvPrefix + "LISTEN")
+    defer os.Unsetenv(EnvPrefix + "GCDELETE")
+
+    cfg, err := Load(fname)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if cfg.Listen != ":9090" || !cfg.GCDelete {
+        t.Errorf("Environment didn't override listen %s or gcdelete %t", cfg.Listen, cfg.GCDelete)
+    }
+
+    if cfg.ScrubInterval != 60 || cfg.GCInterval != Defaults().GCInterval {
+        t.Errorf("Unexpected scrubinterval %d or gcinterval %d", cfg.ScrubInterval, cfg.GCInterval)
+    }
+}
+
+func TestLoadInvalidEnv(t *testing.T) {
+    fname := writeConfig(t, `{}`)
+    defer os.Remove(fname)
+
+    os.Setenv(EnvPrefix + "GCINTERVAL", "daily")
+    defer os.Unsetenv(EnvPrefix + "GCINTERVAL")
+
+    if _, err := Load(fname); err == nil {
+        t.Errorf("Non-numeric gcinterval was accepted")
+    }
+}
+
+func TestLoadRejects(t *testing.T) {
+    samples := []string{
+        `{"lisen": ":9000"}`,
+        `{"gcinterval": -1}`,
+        `{"mirrors": [{"url": "https://images.example.com", "filters": {"colour": "blue"}}]}`,
+    }
+
+    for _, sample := range samples {
+        fname := writeConfig(t, sample)
+        defer os.Remove(fname)
+
+        if _, err := Load(fname); err == nil {
+            t.Errorf("Config %s was accepted", sample)
+        }
+    }
+}
+
+func TestReloadKeepsRestartOnly(t *testing.T) {
+    fname := writeConfig(t, `{"listen": ":9000", "trashretention": 60}`)
+    defer os.Remove(fname)
+
+    cfg, ignored, err := Defaults().Reload(fname)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if cfg.Listen != Defaults().Listen || cfg.TrashRetention != 60 {
+        t.Errorf("Unexpected listen %s or trashretention %d", cfg.Listen, cfg.TrashRetention)
+    }
+
+    if len(ignored) != 1 || ignored[0] != "listen" {
+        t.Errorf("Unexpected ignored settings %v", ignored)
+    }
+}
@@ -60,10 +60,26 @@ func UnauthorizedError(err error) Error {
     return &e{"UnauthorizedError", "Unauthorized", 401, err}
 }
 
+func CursorExpired(err error) Error {
+    return &e{"CursorExpired", "Changes since the given sequence are no longer available.", 410, err}
+}
+
+func ReplicaReadOnly(err error) Error {
+    return &e{"ReplicaReadOnly", "Images can only be changed on the primary.", 503, err}
+}
+
+func InvalidStateTransition(err error) Error {
+    return &e{"InvalidStateTransition", "The action is not allowed in the current state of the image.", 409, err}
+}
+
 func BadRequestError(err error) Error {
     return &e{"BadRequestError", "Bad Request", 400, err}
 }
 
+func BadGatewayError(err error) Error {
+    return &e{"BadGatewayError", "Bad Gateway", 502, err}
+}
+
 type Error interface {
     Data() *Data
     StatusCode() int
@@ -0,0 +1,136 @@
+package gc
+
+import (
+    "sync"
+    "time"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/log"
+)
+
+const (
+    Actor = "gc"
+)
+
+// Options are the settings of the scheduled garbage collection, Interval
+// and MaxAge are given in seconds. Garbage is only reported unless Delete
+// is set.
+type Options struct {
+    Interval int
+    MaxAge int
+    Delete bool
+}
+
+func (self Options) gcOptions() image.GCOptions {
+    return image.GCOptions{
+        MaxAge: time.Duration(self.MaxAge) * time.Second,
+        RemoveFiles: self.Delete,
+        RemoveImages: self.Delete,
+        Actor: Actor,
+    }
+}
+
+// Collector runs a garbage collection pass every interval and keeps the
+// report of the last one. A zero interval disables the scheduled passes.
+type Collector struct {
+    pool *image.Pool
+    opts Options
+    report *image.GCReport
+    wake chan struct{}
+    quit chan struct{}
+    done chan struct{}
+    logger *log.Logger
+    mutex *sync.Mutex
+}
+
+func New(pool *image.Pool, opts Options, logger *log.Logger) *Collector {
+    collector := &Collector{
+        pool: pool,
+        opts: opts,
+        logger: logger,
+        wake: make(chan struct{}, 1),
+        quit: make(chan struct{}),
+        done: make(chan struct{}),
+        mutex: &sync.Mutex{},
+    }
+
+    go collector.run()
+
+    return collector
+}
+
+// SetOptions replaces the options, the next pass is scheduled
+// an interval after the last one
+func (self *Collector) SetOptions(opts Options) {
+    self.mutex.Lock()
+    self.opts = opts
+    self.mutex.Unlock()
+
+    select {
+    case self.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Report returns the report of the last pass or nil if there was none
+func (self *Collector) Report() *image.GCReport {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.report
+}
+
+// Close stops the scheduled passes and waits for a running one to finish
+func (self *Collector) Close() {
+    close(self.quit)
+    <-self.done
+}
+
+func (self *Collector) run() {
+    defer close(self.done)
+
+    last := time.Now()
+
+    for {
+        var timer <-chan time.Time
+        opts := self.options()
+        if opts.Interval > 0 {
+            interval := time.Duration(opts.Interval) * time.Second
+            timer = time.After(time.Until(last.Add(interval)))
+        }
+
+        select {
+        case <-timer:
+            last = time.Now()
+            self.collect(opts)
+        case <-self.wake:
+        case <-self.quit:
+            return
+        }
+    }
+}
+
+func (self *Collector) options() Options {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.opts
+}
+
+func (self *Collector) collect(opts Options) {
+    report, err := self.pool.GC(opts.gcOptions())
+    if err != nil {
+        self.logger.Errorf("Garbage collection failed: %s", err)
+        return
+    }
+
+    verb := "Found"
+    if opts.Delete {
+        verb = "Removed"
+    }
+    self.logger.Infof("%s %d orphaned files, %d temp files (%d bytes) and %d stale images", verb, len(report.OrphanedFiles), len(report.TempFiles), report.Bytes, len(report.StaleImages))
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.report = report
+}
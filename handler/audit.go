@@ -0,0 +1,19 @@
+package handler
+
+import (
+    "net/http"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+func (self *Handler) getAudit(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
+    query := req.URL.Query()
+
+    // Return the entries of all images if no uuid is given
+    entries, err := self.audit.Query(query.Get("uuid"))
+    if err != nil {
+        logres.Error(errors.InternalError(err))
+        return
+    }
+
+    logres.JSON(entries)
+}
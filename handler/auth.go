@@ -0,0 +1,67 @@
+package handler
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// SetOperators maps client certificate subjects to operator identities.
+// Once set, the mutating endpoints require a verified client certificate
+// with one of the given subjects. A nil map allows anyone.
+func (self *Handler) SetOperators(operators map[string]string) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.operators = operators
+}
+
+// operator returns the operator identity of the request. An empty
+// identity is returned if operators are not required.
+func (self *Handler) operator(req *http.Request) (string, errors.Error) {
+    self.mutex.RLock()
+    defer self.mutex.RUnlock()
+
+    if self.operators == nil {
+        return "", nil
+    }
+
+    // Client certificate must have been verified against the client CA
+    if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+        return "", errors.UnauthorizedError(nil)
+    }
+
+    subject := req.TLS.VerifiedChains[0][0].Subject.String()
+
+    identity, ok := self.operators[subject]
+    if !ok {
+        err := fmt.Errorf("Unknown operator subject: %s", subject)
+        return "", errors.OperatorOnly(err)
+    }
+
+    return identity, nil
+}
+
+// actor returns the identity recorded in the audit log for changes made
+// by the request, which is the operator identity if operators are required
+// and the remote host otherwise
+func (self *Handler) actor(req *http.Request) string {
+    if operator, err := self.operator(req); err == nil && operator != "" {
+        return operator
+    }
+
+    host, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        return req.RemoteAddr
+    }
+    return host
+}
+
+func (self *Handler) authorized(req *http.Request, logres *LogResponder) bool {
+    if _, err := self.operator(req); err != nil {
+        logres.Error(err)
+        return false
+    }
+    return true
+}
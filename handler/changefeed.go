@@ -0,0 +1,154 @@
+package handler
+
+import (
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "net/http"
+    "encoding/json"
+    "github.com/prasmussen/smartimages/errors"
+    "github.com/prasmussen/smartimages/changefeed"
+)
+
+const (
+    defaultPollTimeout = 30 * time.Second
+    maxPollTimeout = 5 * time.Minute
+    keepaliveInterval = 15 * time.Second
+)
+
+type changes struct {
+    Seq uint64 `json:"seq"`
+    Changes []*changefeed.Entry `json:"changes"`
+}
+
+// getChangefeed returns the changes after the sequence number given in the
+// since parameter. Clients accepting text/event-stream get a stream of server
+// sent events, everyone else a long-poll response which is returned as soon
+// as there are changes or the timeout (in seconds) expires. Without the since
+// parameter the stream starts at the latest change and the long-poll returns
+// the latest sequence number to be used as cursor.
+func (self *Handler) getChangefeed(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
+    query := req.URL.Query()
+
+    stream := strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+
+    // Resume from the last event seen if an event stream reconnects
+    since := query.Get("since")
+    if since == "" && stream {
+        since = req.Header.Get("Last-Event-ID")
+    }
+
+    seq := self.feed.Seq()
+    if since != "" {
+        var err error
+        seq, err = strconv.ParseUint(since, 10, 64)
+        if err != nil {
+            logres.Error(errors.InvalidParameter(err))
+            return
+        }
+    }
+
+    timeout := defaultPollTimeout
+    if str := query.Get("timeout"); str != "" {
+        seconds, err := strconv.Atoi(str)
+        if err != nil || seconds < 0 {
+            logres.Error(errors.InvalidParameter(err))
+            return
+        }
+
+        timeout = time.Duration(seconds) * time.Second
+        if timeout > maxPollTimeout {
+            timeout = maxPollTimeout
+        }
+    }
+
+    // Make sure the cursor is valid before we start responding
+    if _, _, err := self.feed.Since(seq); err != nil {
+        logres.Error(errors.CursorExpired(err))
+        return
+    }
+
+    if stream {
+        self.streamChanges(res, req, logres, seq)
+    } else {
+        self.pollChanges(req, logres, seq, timeout)
+    }
+}
+
+func (self *Handler) pollChanges(req *http.Request, logres *LogResponder, seq uint64, timeout time.Duration) {
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+
+    for {
+        entries, changed, err := self.feed.Since(seq)
+        if err != nil {
+            logres.Error(errors.CursorExpired(err))
+            return
+        }
+
+        if len(entries) > 0 {
+            logres.JSON(&changes{entries[len(entries) - 1].Seq, entries})
+            return
+        }
+
+        select {
+        case <-changed:
+            continue
+        case <-timer.C:
+        case <-self.feed.Stopped():
+        case <-req.Context().Done():
+        }
+
+        // No changes, return the cursor unchanged
+        logres.JSON(&changes{seq, entries})
+        return
+    }
+}
+
+func (self *Handler) streamChanges(res http.ResponseWriter, req *http.Request, logres *LogResponder, seq uint64) {
+    flusher, ok := res.(http.Flusher)
+    if !ok {
+        logres.Error(errors.InternalError(fmt.Errorf("Streaming is not supported")))
+        return
+    }
+
+    res.Header().Set("Content-Type", "text/event-stream")
+    res.Header().Set("Cache-Control", "no-cache")
+    res.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    keepalive := time.NewTicker(keepaliveInterval)
+    defer keepalive.Stop()
+
+    for {
+        entries, changed, err := self.feed.Since(seq)
+        if err != nil {
+            // Tell the client to start over with a full listing
+            fmt.Fprintf(res, "event: expired\ndata: %s\n\n", err)
+            flusher.Flush()
+            logres.Logger.Error(err)
+            return
+        }
+
+        for _, entry := range entries {
+            data, _ := json.Marshal(entry)
+            fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", entry.Seq, entry.Action, data)
+            seq = entry.Seq
+        }
+        flusher.Flush()
+
+        select {
+        case <-changed:
+        case <-keepalive.C:
+            fmt.Fprint(res, ": keepalive\n\n")
+            flusher.Flush()
+        case <-self.feed.Stopped():
+            logres.Logger.Success()
+            return
+        case <-req.Context().Done():
+            logres.Logger.Success()
+            return
+        }
+    }
+}
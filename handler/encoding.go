@@ -0,0 +1,62 @@
+package handler
+
+import (
+    "sort"
+    "strings"
+    "strconv"
+)
+
+// Compression parameter picking the file by the Accept-Encoding header,
+// http clients send one by default so it is only used when asked for
+const autoCompression = "auto"
+
+// Accept-Encoding tokens for the compressions image files can have
+var encodingCompressions = map[string]string{
+    "gzip": "gzip",
+    "x-gzip": "gzip",
+    "bzip2": "bzip2",
+    "x-bzip2": "bzip2",
+    "xz": "xz",
+    "x-xz": "xz",
+}
+
+// acceptedCompressions returns the compressions listed in an Accept-Encoding
+// header, most preferred first. The file is served as it is stored, so the
+// compression is not a content encoding but part of the file.
+func acceptedCompressions(header string) []string {
+    type accepted struct {
+        compression string
+        q float64
+    }
+
+    list := make([]accepted, 0)
+    for _, part := range strings.Split(header, ",") {
+        params := strings.Split(part, ";")
+        compression, ok := encodingCompressions[strings.ToLower(strings.TrimSpace(params[0]))]
+        if !ok {
+            continue
+        }
+
+        q := 1.0
+        for _, param := range params[1:] {
+            param = strings.TrimSpace(param)
+            if strings.HasPrefix(param, "q=") {
+                q, _ = strconv.ParseFloat(param[2:], 64)
+            }
+        }
+
+        if q > 0 {
+            list = append(list, accepted{compression, q})
+        }
+    }
+
+    sort.SliceStable(list, func(i, j int) bool {
+        return list[i].q > list[j].q
+    })
+
+    compressions := make([]string, 0, len(list))
+    for _, a := range list {
+        compressions = append(compressions, a.compression)
+    }
+    return compressions
+}
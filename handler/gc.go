@@ -0,0 +1,17 @@
+package handler
+
+import (
+    "net/http"
+    "github.com/prasmussen/smartimages/image"
+)
+
+type gcStatus struct {
+    Last *image.GCReport `json:"last"`
+}
+
+// getGC returns the report of the last garbage collection pass
+func (self *Handler) getGC(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
+    logres.JSON(&gcStatus{
+        Last: self.collector.Report(),
+    })
+}
@@ -1,24 +1,69 @@
 package handler
 
 import (
+    "sync"
+    "time"
+    "strconv"
     "net/http"
+    "github.com/prasmussen/smartimages/audit"
+    "github.com/prasmussen/smartimages/changefeed"
+    "github.com/prasmussen/smartimages/errors"
+    "github.com/prasmussen/smartimages/gc"
     "github.com/prasmussen/smartimages/image"
     "github.com/prasmussen/smartimages/log"
+    "github.com/prasmussen/smartimages/metrics"
+    "github.com/prasmussen/smartimages/proxy"
+    "github.com/prasmussen/smartimages/replication"
     "github.com/prasmussen/smartimages/responder"
+    "github.com/prasmussen/smartimages/scrub"
 )
 
 type Handler struct {
     images *image.Pool
     logger *log.Logger
+    metrics *metrics.Metrics
+    audit *audit.Log
+    feed *changefeed.Feed
+    proxy *proxy.Proxy
+    replica *replication.Follower
+    scrubber *scrub.Scrubber
+    collector *gc.Collector
+    operators map[string]string
+    mutex *sync.RWMutex
 }
 
-func New(pool *image.Pool, logger *log.Logger) *Handler {
+func New(pool *image.Pool, logger *log.Logger, m *metrics.Metrics, auditLog *audit.Log, feed *changefeed.Feed) *Handler {
     return &Handler{
         images: pool,
         logger: logger,
+        metrics: m,
+        audit: auditLog,
+        feed: feed,
+        mutex: &sync.RWMutex{},
     }
 }
 
+// SetProxy enables serving images that are not in the pool from an upstream
+func (self *Handler) SetProxy(p *proxy.Proxy) {
+    self.proxy = p
+}
+
+// SetReplica makes the handler a secondary of the primary followed by f,
+// the catalog can't be changed by clients until f is promoted
+func (self *Handler) SetReplica(f *replication.Follower) {
+    self.replica = f
+}
+
+// SetScrubber enables reporting the results of the background scrubber
+func (self *Handler) SetScrubber(s *scrub.Scrubber) {
+    self.scrubber = s
+}
+
+// SetCollector enables reporting the results of the garbage collection
+func (self *Handler) SetCollector(c *gc.Collector) {
+    self.collector = c
+}
+
 func (self *Handler) LogResponder(req *http.Request, res http.ResponseWriter) *LogResponder {
     return &LogResponder{
         Logger: self.logger.RequestStart(req),
@@ -28,73 +73,100 @@ func (self *Handler) LogResponder(req *http.Request, res http.ResponseWriter) *L
 
 
 func (self *Handler) GetImage() func(res http.ResponseWriter, req *http.Request) {
-    return func(res http.ResponseWriter, req *http.Request) {
-        logres := self.LogResponder(req, res)
-        defer logres.Logger.RequestEnd()
-
-        self.getImage(res, req, logres)
-    }
+    return self.handle("get_image", false, self.getImage)
 }
 
 func (self *Handler) GetImageFile() func(res http.ResponseWriter, req *http.Request) {
-    return func(res http.ResponseWriter, req *http.Request) {
-        logres := self.LogResponder(req, res)
-        defer logres.Logger.RequestEnd()
-
-        self.getImageFile(res, req, logres)
-    }
+    return self.handle("get_image_file", false, self.getImageFile)
 }
 
 func (self *Handler) ListImages() func(res http.ResponseWriter, req *http.Request) {
-    return func(res http.ResponseWriter, req *http.Request) {
-        logres := self.LogResponder(req, res)
-        defer logres.Logger.RequestEnd()
-
-        self.listImages(res, req, logres)
-    }
+    return self.handle("list_images", false, self.listImages)
 }
 
 func (self *Handler) CreateImage() func(res http.ResponseWriter, req *http.Request) {
-    return func(res http.ResponseWriter, req *http.Request) {
-        logres := self.LogResponder(req, res)
-        defer logres.Logger.RequestEnd()
-
-        self.createImage(res, req, logres)
-    }
+    return self.handle("create_image", true, self.primaryOnly(self.createImage))
 }
 
 func (self *Handler) AddImageFile() func(res http.ResponseWriter, req *http.Request) {
-    return func(res http.ResponseWriter, req *http.Request) {
-        logres := self.LogResponder(req, res)
-        defer logres.Logger.RequestEnd()
-
-        self.addImageFile(res, req, logres)
-    }
+    return self.handle("add_image_file", true, self.primaryOnly(self.addImageFile))
 }
 
 func (self *Handler) ImageAction() func(res http.ResponseWriter, req *http.Request) {
-    return func(res http.ResponseWriter, req *http.Request) {
-        logres := self.LogResponder(req, res)
-        defer logres.Logger.RequestEnd()
-
-        self.imageAction(res, req, logres)
-    }
+    return self.handle("image_action", true, self.primaryOnly(self.imageAction))
 }
 
 func (self *Handler) DeleteImage() func(res http.ResponseWriter, req *http.Request) {
+    return self.handle("delete_image", true, self.primaryOnly(self.deleteImage))
+}
+
+func (self *Handler) Ping() func(res http.ResponseWriter, req *http.Request) {
+    return self.handle("ping", false, self.ping)
+}
+
+func (self *Handler) Metrics() func(res http.ResponseWriter, req *http.Request) {
+    return self.handle("metrics", false, self.getMetrics)
+}
+
+func (self *Handler) Audit() func(res http.ResponseWriter, req *http.Request) {
+    return self.handle("audit", true, self.getAudit)
+}
+
+func (self *Handler) Changefeed() func(res http.ResponseWriter, req *http.Request) {
+    return self.handle("changefeed", false, self.getChangefeed)
+}
+
+func (self *Handler) Scrub() func(res http.ResponseWriter, req *http.Request) {
+    return self.handle("scrub", true, self.getScrub)
+}
+
+func (self *Handler) GC() func(res http.ResponseWriter, req *http.Request) {
+    return self.handle("gc", true, self.getGC)
+}
+
+func (self *Handler) ReplicationAction() func(res http.ResponseWriter, req *http.Request) {
+    return self.handle("replication_action", true, self.replicationAction)
+}
+
+type handlerFunc func(res http.ResponseWriter, req *http.Request, logres *LogResponder)
+
+// handle wraps fn with request logging and metrics. Operator only
+// handlers are not called unless the request is from an operator.
+func (self *Handler) handle(route string, operatorOnly bool, fn handlerFunc) func(res http.ResponseWriter, req *http.Request) {
     return func(res http.ResponseWriter, req *http.Request) {
-        logres := self.LogResponder(req, res)
-        defer logres.Logger.RequestEnd()
+        start := time.Now()
+        writer := newResponseWriter(res)
+
+        logres := self.LogResponder(req, writer)
 
-        self.deleteImage(res, req, logres)
+        defer func() {
+            logres.Logger.RequestEnd(writer.status, writer.bytes)
+
+            status := strconv.Itoa(writer.status)
+            self.metrics.Requests.Inc(route, status)
+            self.metrics.RequestDuration.Observe(metrics.Since(start), route, status)
+        }()
+
+        // Echo request id so clients can correlate their requests with the log
+        writer.Header().Set(log.RequestIdHeader, logres.Logger.Id())
+
+        if operatorOnly && !self.authorized(req, logres) {
+            return
+        }
+
+        fn(writer, req, logres)
     }
 }
 
-func (self *Handler) Ping() func(res http.ResponseWriter, req *http.Request) {
-    return func(res http.ResponseWriter, req *http.Request) {
-        logres := self.LogResponder(req, res)
-        defer logres.Logger.RequestEnd()
+// primaryOnly wraps handlers which change the catalog,
+// they are refused while the instance is a secondary
+func (self *Handler) primaryOnly(fn handlerFunc) handlerFunc {
+    return func(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
+        if self.replica != nil && self.replica.IsSecondary() {
+            logres.Error(errors.ReplicaReadOnly(nil))
+            return
+        }
 
-        self.ping(res, req, logres)
+        fn(res, req, logres)
     }
 }
@@ -1,6 +1,7 @@
 package handler
 
 import (
+    "fmt"
     "net/http"
     "io"
     "encoding/json"
@@ -13,13 +14,32 @@ func (self *Handler) getImage(res http.ResponseWriter, req *http.Request, logres
 
     uuid := query.Get(":uuid")
 
+    version, err := manifestVersion(req)
+    if err != nil {
+        logres.Error(err)
+        return
+    }
+
     manifest, err := self.images.Get(uuid)
+    if err != nil && self.proxy != nil && err.StatusCode() == http.StatusNotFound {
+        manifest, err = self.proxy.GetManifest(uuid)
+    } else if err == nil && manifest.State == image.StateDeleted {
+        // Images in the trash are gone as far as clients are concerned
+        err = errors.ResourceNotFound(fmt.Errorf("Image is deleted"))
+    }
+
     if err != nil {
         logres.Error(err)
         return
     }
 
-    logres.JSON(manifest)
+    versioned, err := versionedManifest(manifest, version)
+    if err != nil {
+        logres.Error(err)
+        return
+    }
+
+    logres.JSON(versioned)
 }
 
 func (self *Handler) getImageFile(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
@@ -27,7 +47,30 @@ func (self *Handler) getImageFile(res http.ResponseWriter, req *http.Request, lo
 
     uuid := query.Get(":uuid")
 
-    reader, metadata, err := self.images.GetFile(uuid)
+    // Pick a file by compression or index and the first one by default,
+    // compression=auto picks it by the compressions the client accepts
+    compression := query.Get("compression")
+    if compression == autoCompression {
+        compression = ""
+    }
+
+    sel, err := image.ParseFileSelector(compression, query.Get("index"))
+    if err != nil {
+        logres.Error(err)
+        return
+    }
+
+    if query.Get("compression") == autoCompression {
+        sel.Preferred = acceptedCompressions(req.Header.Get("Accept-Encoding"))
+        res.Header().Add("Vary", "Accept-Encoding")
+    }
+
+    reader, metadata, err := self.images.GetFile(uuid, sel)
+    if err != nil && err.StatusCode() == http.StatusNotFound && self.proxiesFile(uuid) {
+        self.proxyImageFile(res, uuid, sel, logres)
+        return
+    }
+
     if err != nil {
         logres.Error(err)
         return
@@ -40,9 +83,43 @@ func (self *Handler) getImageFile(res http.ResponseWriter, req *http.Request, lo
     // really needed, but the imgadm expects it
     logres.Responder.SetContentMd5(metadata.Md5sum)
     logres.Responder.SetContentLength(metadata.Size)
+    logres.Responder.SetImageFile(metadata.Sha1, metadata.Compression)
 
     // Write file to response
-    io.Copy(res, reader)
+    self.metrics.ActiveTransfers.Inc("download")
+    nBytes, _ := io.Copy(res, reader)
+    self.metrics.ActiveTransfers.Dec("download")
+    self.metrics.BytesDownloaded.Add(float64(nBytes))
+
+    logres.Logger.Success()
+}
+
+// proxiesFile returns true if the file of uuid is fetched through the proxy
+// when it can't be served from the pool, which is the case for unknown
+// images and for evicted files of images that came from another server
+func (self *Handler) proxiesFile(uuid string) bool {
+    if self.proxy == nil {
+        return false
+    }
+
+    manifest, err := self.images.Get(uuid)
+    if err != nil {
+        return err.StatusCode() == http.StatusNotFound
+    }
+
+    return manifest.Source != "" && manifest.State != image.StateDeleted && manifest.State != image.StateFailed
+}
+
+func (self *Handler) proxyImageFile(res http.ResponseWriter, uuid string, sel image.FileSelector, logres *LogResponder) {
+    self.metrics.ActiveTransfers.Inc("download")
+    nBytes, err := self.proxy.ServeFile(res, uuid, sel)
+    self.metrics.ActiveTransfers.Dec("download")
+    self.metrics.BytesDownloaded.Add(float64(nBytes))
+
+    if err != nil {
+        logres.Error(err)
+        return
+    }
 
     logres.Logger.Success()
 }
@@ -50,6 +127,12 @@ func (self *Handler) getImageFile(res http.ResponseWriter, req *http.Request, lo
 func (self *Handler) listImages(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
     query := req.URL.Query()
 
+    version, err := manifestVersion(req)
+    if err != nil {
+        logres.Error(err)
+        return
+    }
+
     filters := make([]image.Filter, 0)
 
     for key, values := range query {
@@ -65,7 +148,12 @@ func (self *Handler) listImages(res http.ResponseWriter, req *http.Request, logr
         filters = append(filters, image.StateFilter("active"))
     }
 
-    manifests := self.images.List(filters)
+    manifests, err := versionedManifests(self.images.List(filters), version)
+    if err != nil {
+        logres.Error(err)
+        return
+    }
+
     logres.JSON(manifests)
 }
 
@@ -76,7 +164,7 @@ func (self *Handler) createImage(res http.ResponseWriter, req *http.Request, log
         return
     }
 
-    if err := self.images.Create(manifest); err != nil {
+    if err := self.images.Create(manifest, self.actor(req)); err != nil {
         logres.Error(err)
         return
     }
@@ -100,7 +188,25 @@ func (self *Handler) addImageFile(res http.ResponseWriter, req *http.Request, lo
         return
     }
 
-    manifest, err := self.images.AddFile(uuid, compression, req.Body)
+    // Replace the file at index, or the file with the same compression
+    index := -1
+    if str := query.Get("index"); str != "" {
+        sel, err := image.ParseFileSelector("", str)
+        if err != nil {
+            logres.Error(err)
+            return
+        }
+        index = sel.Index
+    }
+
+    // Count bytes received, even for failed uploads
+    body := &countingReader{reader: req.Body}
+
+    self.metrics.ActiveTransfers.Inc("upload")
+    manifest, err := self.images.AddFile(uuid, compression, index, body, self.actor(req))
+    self.metrics.ActiveTransfers.Dec("upload")
+    self.metrics.BytesUploaded.Add(float64(body.n))
+
     if err != nil {
         logres.Error(err)
         return
@@ -117,17 +223,23 @@ func (self *Handler) imageAction(res http.ResponseWriter, req *http.Request, log
 
     uuid := query.Get(":uuid")
     action := query.Get("action")
+    actor := self.actor(req)
 
     var manifest *image.Manifest
     var err errors.Error
 
     switch action {
     case "activate":
-        manifest, err = self.images.Activate(uuid)        
+        manifest, err = self.images.Activate(uuid, actor)        
     case "enable":
-        manifest, err = self.images.SetDisabled(uuid, false)
+        manifest, err = self.images.SetDisabled(uuid, false, actor)
     case "disable":
-        manifest, err = self.images.SetDisabled(uuid, true)
+        manifest, err = self.images.SetDisabled(uuid, true, actor)
+    case "restore":
+        manifest, err = self.images.Restore(uuid, actor)
+    case "verify":
+        self.verifyImage(uuid, actor, logres)
+        return
     case "":
         err = errors.InvalidParameter(nil)
     default:
@@ -148,10 +260,20 @@ func (self *Handler) deleteImage(res http.ResponseWriter, req *http.Request, log
     // Grab uuid
     uuid := query.Get(":uuid")
 
-    if err := self.images.Delete(uuid); err != nil {
+    if err := self.images.Delete(uuid, self.actor(req)); err != nil {
         logres.Error(err)
         return
     }
 
     logres.Success(204)
 }
+
+func (self *Handler) verifyImage(uuid, actor string, logres *LogResponder) {
+    result, err := self.images.Verify(uuid, actor)
+    if err != nil {
+        logres.Error(err)
+        return
+    }
+
+    logres.JSON(result)
+}
@@ -0,0 +1,18 @@
+package handler
+
+import (
+    "net/http"
+)
+
+func (self *Handler) getMetrics(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
+    // Image counts are calculated on every scrape
+    self.metrics.Images.Reset()
+    for state, count := range self.images.CountByState() {
+        self.metrics.Images.Set(float64(count), string(state))
+    }
+
+    res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    self.metrics.Write(res)
+
+    logres.Logger.Success()
+}
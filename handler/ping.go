@@ -2,20 +2,38 @@ package handler
 
 import (
     "net/http"
+    "github.com/prasmussen/smartimages/replication"
 )
 
-var defaultPong = &Pong{
-    Ping: "pong",
-    Version: "1.0.0",
-    Imgapi: true,
-}
-
 type Pong struct {
     Ping string `json:"ping"`
     Version string `json:"version"`
     Imgapi bool `json:"imgapi"`
+    Replication *replication.Status `json:"replication"`
 }
 
 func (self *Handler) ping(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
-    logres.JSON(defaultPong)
+    pong := &Pong{
+        Ping: "pong",
+        Version: "1.0.0",
+        Imgapi: true,
+        Replication: self.replicationStatus(),
+    }
+
+    logres.JSON(pong)
+}
+
+func (self *Handler) replicationStatus() *replication.Status {
+    // Instances without a primary to follow are primaries themselves
+    status := &replication.Status{Role: replication.RolePrimary}
+    if self.replica != nil {
+        status = self.replica.Status()
+    }
+
+    // The sequence number of a primary is the one secondaries follow
+    if status.Role == replication.RolePrimary {
+        status.Seq = self.feed.Seq()
+    }
+
+    return status
 }
@@ -0,0 +1,33 @@
+package handler
+
+import (
+    "fmt"
+    "net/http"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+func (self *Handler) replicationAction(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
+    query := req.URL.Query()
+
+    // Close body
+    defer req.Body.Close()
+
+    if self.replica == nil {
+        err := fmt.Errorf("Replication is not enabled")
+        logres.Error(errors.InvalidParameter(err))
+        return
+    }
+
+    switch query.Get("action") {
+    case "promote":
+        if err := self.replica.Promote(); err != nil {
+            logres.Error(errors.InternalError(err))
+            return
+        }
+    default:
+        logres.Error(errors.InvalidParameter(nil))
+        return
+    }
+
+    logres.JSON(self.replicationStatus())
+}
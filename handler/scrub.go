@@ -0,0 +1,22 @@
+package handler
+
+import (
+    "net/http"
+    "github.com/prasmussen/smartimages/scrub"
+)
+
+type scrubStatus struct {
+    Running bool `json:"running"`
+    Last *scrub.Report `json:"last"`
+}
+
+// getScrub returns the report of the last scrub, which lists
+// the images that failed verification
+func (self *Handler) getScrub(res http.ResponseWriter, req *http.Request, logres *LogResponder) {
+    report, running := self.scrubber.Report()
+
+    logres.JSON(&scrubStatus{
+        Running: running,
+        Last: report,
+    })
+}
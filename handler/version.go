@@ -0,0 +1,60 @@
+package handler
+
+import (
+    "mime"
+    "strconv"
+    "net/http"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// manifestVersion returns the manifest version requested with the v query
+// parameter or a v parameter on the Accept header, like
+// "application/json; v=1". The query parameter takes precedence.
+func manifestVersion(req *http.Request) (int, errors.Error) {
+    str := req.URL.Query().Get("v")
+
+    if str == "" {
+        if _, params, err := mime.ParseMediaType(req.Header.Get("Accept")); err == nil {
+            str = params["v"]
+        }
+    }
+
+    if str == "" {
+        return image.ManifestVersion, nil
+    }
+
+    version, err := strconv.Atoi(str)
+    if err != nil || version < image.MinManifestVersion || version > image.ManifestVersion {
+        return 0, errors.InvalidParameter(err)
+    }
+
+    return version, nil
+}
+
+// versionedManifest converts the manifest to the requested version
+func versionedManifest(m *image.Manifest, version int) (interface{}, errors.Error) {
+    versioned, err := image.ManifestAs(m, version)
+    if err != nil {
+        return nil, errors.InternalError(err)
+    }
+    return versioned, nil
+}
+
+// versionedManifests converts the manifests to the requested version
+func versionedManifests(manifests []*image.Manifest, version int) (interface{}, errors.Error) {
+    if version == image.ManifestVersion {
+        return manifests, nil
+    }
+
+    versioned := make([]interface{}, 0, len(manifests))
+    for _, m := range manifests {
+        v, err := versionedManifest(m, version)
+        if err != nil {
+            return nil, err
+        }
+        versioned = append(versioned, v)
+    }
+
+    return versioned, nil
+}
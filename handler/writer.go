@@ -0,0 +1,50 @@
+package handler
+
+import (
+    "io"
+    "net/http"
+)
+
+// responseWriter records the status code and the number of bytes written
+type responseWriter struct {
+    http.ResponseWriter
+    status int
+    bytes int64
+}
+
+func newResponseWriter(res http.ResponseWriter) *responseWriter {
+    return &responseWriter{
+        ResponseWriter: res,
+        status: http.StatusOK,
+    }
+}
+
+func (self *responseWriter) WriteHeader(status int) {
+    self.status = status
+    self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *responseWriter) Write(p []byte) (int, error) {
+    n, err := self.ResponseWriter.Write(p)
+    self.bytes += int64(n)
+    return n, err
+}
+
+// Flush is needed to stream the changefeed
+func (self *responseWriter) Flush() {
+    if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+        flusher.Flush()
+    }
+}
+
+// countingReader counts the number of bytes read
+type countingReader struct {
+    reader io.Reader
+    n int64
+}
+
+func (self *countingReader) Read(p []byte) (int, error) {
+    n, err := self.reader.Read(p)
+    self.n += int64(n)
+    return n, err
+}
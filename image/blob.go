@@ -0,0 +1,260 @@
+package image
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "crypto/md5"
+    "crypto/sha1"
+    "io/ioutil"
+    "path/filepath"
+    "github.com/prasmussen/smartimages/errors"
+    "github.com/prasmussen/smartimages/atomicfile"
+)
+
+// Image files are stored once per sha1 in the blob directory as
+// <sha1[:2]>/<sha1> with the md5 sum in <sha1>.md5 next to it. A blob
+// is referenced by every manifest with a file of the same sha1 and it is
+// removed when the last one of them goes away.
+
+// commitFunc is called with the pool locked once a blob is in place,
+// the blob is released again if it returns an error
+type commitFunc func(*ImageFile) errors.Error
+
+// writeFile writes an image file to the blob store and calls commit with
+// its metadata. If the blob already exists it is replaced by the written
+// file, which repairs a corrupt blob. If expectedSha1 is given the file
+// is discarded unless its sha1 matches.
+func (self *Pool) writeFile(compression string, reader io.Reader, expectedSha1 string, commit commitFunc) (*ImageFile, errors.Error) {
+    // Make sure we know the file extension for the given compression type
+    if _, ok := FileExtensions[compression]; !ok {
+        return nil, errors.InvalidParameter(nil)
+    }
+
+    if expectedSha1 != "" && !ValidSha1(expectedSha1) {
+        err := fmt.Errorf("Invalid sha1 %q", expectedSha1)
+        return nil, errors.ValidationFailed(err)
+    }
+
+    // Register upload so it can be aborted on shutdown
+    reader, done, err := self.uploads.start(reader)
+    if err != nil {
+        return nil, errors.ServiceUnavailableError(err)
+    }
+    defer done()
+
+    // Create destination directory if it does not exist
+    if err := os.MkdirAll(self.blobDir, 0775); err != nil {
+        return nil, errors.InternalError(err)
+    }
+
+    // Write to a partial file which is renamed when the upload is
+    // complete, so an interrupted upload never leaves a torn image behind
+    f, err := ioutil.TempFile(self.blobDir, ".upload")
+    if err != nil {
+        return nil, errors.InternalError(err)
+    }
+    partFpath := f.Name()
+
+    // Remember to close files
+    defer f.Close()
+
+    // Calcluate sha1 and md5 sum while writing image to disk
+    // Sha1 is a required field in the manifest
+    shaHash := sha1.New()
+    sha1Reader := io.TeeReader(reader, shaHash)
+
+    // Md5 is needed by imgadm client which expects the
+    // content-md5 header to be present
+    md5Hash := md5.New()
+    md5Reader := io.TeeReader(sha1Reader, md5Hash)
+
+    // Write image to disk
+    nBytes, err := io.Copy(f, md5Reader)
+    if err == nil {
+        err = f.Close()
+    }
+    if err != nil {
+        f.Close()
+        os.Remove(partFpath)
+
+        if err == ErrUploadAborted {
+            return nil, errors.ServiceUnavailableError(err)
+        }
+        return nil, errors.Upload(err)
+    }
+
+    // Verify the checksum of imported files before they are used
+    sha1sum := fmt.Sprintf("%x", shaHash.Sum(nil))
+    if expectedSha1 != "" && sha1sum != expectedSha1 {
+        os.Remove(partFpath)
+        err := fmt.Errorf("Sha1 mismatch, expected %s got %s", expectedSha1, sha1sum)
+        return nil, errors.Upload(err)
+    }
+
+    imageFile := &ImageFile{
+        Sha1: sha1sum,
+        Compression: compression,
+        Size: nBytes,
+    }
+
+    // Placing the blob and committing it happens with the pool locked,
+    // so it can't be released by a delete of another image in between
+    self.lock()
+    defer self.unlock()
+
+    if err := self.placeBlob(partFpath, sha1sum, md5Hash.Sum(nil)); err != nil {
+        os.Remove(partFpath)
+        return nil, errors.InternalError(err)
+    }
+
+    if commit != nil {
+        if err := commit(imageFile); err != nil {
+            self.releaseBlob(sha1sum)
+            return nil, err
+        }
+    }
+
+    return imageFile, nil
+}
+
+// placeBlob moves the file at fpath into the blob store, replacing the
+// blob if it already exists. The caller must hold the lock.
+func (self *Pool) placeBlob(fpath, sha1sum string, md5sum []byte) error {
+    blobFpath := self.blobFpath(sha1sum)
+
+    if err := os.MkdirAll(filepath.Dir(blobFpath), 0775); err != nil {
+        return err
+    }
+
+    if err := os.Rename(fpath, blobFpath); err != nil {
+        return err
+    }
+
+    // Write md5sum to file
+    return atomicfile.WriteData(self.blobMd5Fpath(sha1sum), md5sum)
+}
+
+// blobReferenced returns true if any manifest has a file with the
+// given sha1, the caller must hold the lock
+func (self *Pool) blobReferenced(sha1sum string) bool {
+    for _, m := range self.manifests {
+        if m.hasFile(sha1sum) {
+            return true
+        }
+    }
+    return false
+}
+
+// releaseFiles releases the blobs of files, the caller must hold the lock
+func (self *Pool) releaseFiles(files []*ImageFile) {
+    for _, file := range files {
+        self.releaseBlob(file.Sha1)
+    }
+}
+
+// releaseBlob removes the blob unless it is still referenced,
+// the caller must hold the lock
+func (self *Pool) releaseBlob(sha1sum string) {
+    if sha1sum == "" || self.blobReferenced(sha1sum) {
+        return
+    }
+
+    os.Remove(self.blobFpath(sha1sum))
+    os.Remove(self.blobMd5Fpath(sha1sum))
+}
+
+// blobExists returns true if the blob with the given sha1 is in the store
+func (self *Pool) blobExists(sha1sum string) bool {
+    _, err := os.Stat(self.blobFpath(sha1sum))
+    return err == nil
+}
+
+// ValidSha1 returns true if sha1sum is 40 lowercase hex characters
+func ValidSha1(sha1sum string) bool {
+    if len(sha1sum) != 40 {
+        return false
+    }
+
+    for _, c := range sha1sum {
+        if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+            return false
+        }
+    }
+    return true
+}
+
+// validateFiles checks that the files of a manifest from another image
+// server have sha1s that can be used as blob names
+func validateFiles(files []*ImageFile) errors.Error {
+    for i, file := range files {
+        if !ValidSha1(file.Sha1) {
+            err := fmt.Errorf("File %d has an invalid sha1 %q", i, file.Sha1)
+            return errors.ValidationFailed(err)
+        }
+    }
+    return nil
+}
+
+// blobFpath returns the path of the blob with the given sha1, an invalid
+// sha1 gets an empty path so it never points outside the blob directory
+func (self *Pool) blobFpath(sha1sum string) string {
+    if !ValidSha1(sha1sum) {
+        return ""
+    }
+    return filepath.Join(self.blobDir, sha1sum[:2], sha1sum)
+}
+
+func (self *Pool) blobMd5Fpath(sha1sum string) string {
+    if !ValidSha1(sha1sum) {
+        return ""
+    }
+    return self.blobFpath(sha1sum) + ".md5"
+}
+
+// migrateFiles moves image files stored per uuid by earlier versions into
+// the blob store and returns the number of files moved. Files of images
+// sharing a blob are removed.
+func (self *Pool) migrateFiles() (int, error) {
+    moved := 0
+
+    for _, m := range self.manifests {
+        if len(m.Files) == 0 {
+            continue
+        }
+
+        file := m.Files[0]
+        legacyFpath := filepath.Join(self.legacyDir, fmt.Sprintf("%s.%s", m.Uuid, FileExtensions[file.Compression]))
+        legacyMd5Fpath := filepath.Join(self.legacyDir, m.Uuid + ".md5")
+
+        if _, err := os.Stat(legacyFpath); os.IsNotExist(err) {
+            continue
+        } else if err != nil {
+            return moved, err
+        }
+
+        // The legacy file isn't verified, so it never replaces a blob
+        if self.blobExists(file.Sha1) {
+            os.Remove(legacyFpath)
+            os.Remove(legacyMd5Fpath)
+            continue
+        }
+
+        md5sum, err := ioutil.ReadFile(legacyMd5Fpath)
+        if err != nil {
+            return moved, err
+        }
+
+        if err := self.placeBlob(legacyFpath, file.Sha1, md5sum); err != nil {
+            return moved, err
+        }
+
+        os.Remove(legacyMd5Fpath)
+        moved++
+    }
+
+    // Only remove the old directory if nothing else is left in it
+    os.Remove(self.legacyDir)
+
+    return moved, nil
+}
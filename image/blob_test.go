@@ -0,0 +1,69 @@
+package image
+
+import (
+    "os"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+const sharedSha1 = "0b3e4d2f16a1c0f6e3b2dd0f3a8c3a2d51e61bfb"
+
+// addBlob places a blob with the given sha1 in the store of pool
+func addBlob(t *testing.T, pool *Pool, sha1sum string) {
+    fpath := filepath.Join(pool.dataDir, "blob")
+    if err := ioutil.WriteFile(fpath, []byte(sha1sum), 0660); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := pool.placeBlob(fpath, sha1sum, []byte("md5")); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestReleaseBlob(t *testing.T) {
+    dir, err := ioutil.TempDir("", "smartimages")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    pool, _, err := openImagePool(dir, nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    addBlob(t, pool, sharedSha1)
+
+    // Two images sharing the same file
+    pool.manifests = []*Manifest{
+        {Uuid: "7d1d6a3c-4a6b-11e5-9ac1-3b7d1ea0c3a5", Files: []*ImageFile{{Sha1: sharedSha1}}},
+        {Uuid: "17c98640-1fdb-11e3-bf51-3708ce78e75a", Files: []*ImageFile{{Sha1: sharedSha1}}},
+    }
+
+    tests := []struct {
+        remaining int
+        exists bool
+    }{
+        {2, true},
+        {1, true},
+        {0, false},
+    }
+
+    for _, test := range tests {
+        released := pool.manifests[test.remaining:]
+        pool.manifests = pool.manifests[:test.remaining]
+
+        for _, m := range released {
+            pool.releaseFiles(m.Files)
+        }
+
+        if pool.blobExists(sharedSha1) != test.exists {
+            t.Errorf("Blob exists is %t with %d references, expected %t", !test.exists, test.remaining, test.exists)
+        }
+    }
+
+    if _, err := ioutil.ReadFile(pool.blobMd5Fpath(sharedSha1)); err == nil {
+        t.Errorf("Md5 file of released blob is left behind")
+    }
+}
@@ -0,0 +1,124 @@
+package image
+
+import (
+    "io"
+    "os"
+    "time"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// CachedFile is an image file the proxy cached, it can be fetched again
+// from the source of the image and is therefore safe to evict
+type CachedFile struct {
+    Uuid string
+    Sha1 string
+    Size int64
+    LastUsed time.Time
+}
+
+// CachedFiles returns the image files of all images cached by the proxy.
+// Files shared with an image that isn't cached, like a mirrored one, are
+// not included, and a file shared by several images is only included once.
+func (self *Pool) CachedFiles() []*CachedFile {
+    self.lock()
+    defer self.unlock()
+
+    files := make([]*CachedFile, 0)
+    seen := make(map[string]bool)
+
+    for _, m := range self.manifests {
+        if !m.Cached {
+            continue
+        }
+
+        for _, file := range m.Files {
+            sha1sum := file.Sha1
+            if seen[sha1sum] || !self.blobEvictable(sha1sum) {
+                continue
+            }
+            seen[sha1sum] = true
+
+            // The modification time is updated every time the file is served
+            info, err := os.Stat(self.blobFpath(sha1sum))
+            if err != nil {
+                continue
+            }
+
+            files = append(files, &CachedFile{
+                Uuid: m.Uuid,
+                Sha1: sha1sum,
+                Size: info.Size(),
+                LastUsed: info.ModTime(),
+            })
+        }
+    }
+
+    return files
+}
+
+// EvictFile removes the image file with the given sha1 of an image cached
+// by the proxy, the manifest is kept so the file can be fetched again
+func (self *Pool) EvictFile(uuid, sha1sum string) errors.Error {
+    manifest, ok := self.findManifest(uuid)
+    if !ok {
+        return errors.ResourceNotFound(nil)
+    }
+
+    self.lock()
+    defer self.unlock()
+
+    if !manifest.Cached || !manifest.hasFile(sha1sum) {
+        return errors.InvalidParameter(nil)
+    }
+
+    if !self.blobEvictable(sha1sum) {
+        return errors.InvalidParameter(nil)
+    }
+
+    os.Remove(self.blobFpath(sha1sum))
+    os.Remove(self.blobMd5Fpath(sha1sum))
+    return nil
+}
+
+// blobEvictable returns true if all images referencing the blob were
+// cached by the proxy, the caller must hold the lock
+func (self *Pool) blobEvictable(sha1sum string) bool {
+    for _, m := range self.manifests {
+        if !m.Cached && m.hasFile(sha1sum) {
+            return false
+        }
+    }
+    return true
+}
+
+// RestoreFile writes the evicted image file at index of an image with a
+// source, the file is only accepted if its sha1 matches the one in the
+// manifest
+func (self *Pool) RestoreFile(uuid string, index int, reader io.Reader) errors.Error {
+    manifest, ok := self.findManifest(uuid)
+    if !ok {
+        return errors.ResourceNotFound(nil)
+    }
+
+    if manifest.Source == "" {
+        return errors.InvalidParameter(nil)
+    }
+
+    file, err := self.selectedFile(manifest, FileSelector{Index: index})
+    if err != nil {
+        return err
+    }
+
+    // The image may have been deleted while the file was written
+    _, err = self.writeFile(file.Compression, reader, file.Sha1, func(*ImageFile) errors.Error {
+        if !self.blobReferenced(file.Sha1) {
+            return errors.ResourceNotFound(nil)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
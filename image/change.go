@@ -0,0 +1,79 @@
+package image
+
+import (
+    "time"
+    "encoding/json"
+)
+
+type Action string
+
+const (
+    ActionCreate Action = "create"
+    ActionUpload Action = "upload"
+    ActionActivate Action = "activate"
+    ActionEnable Action = "enable"
+    ActionDisable Action = "disable"
+    ActionDelete Action = "delete"
+    ActionRestore Action = "restore"
+    ActionPurge Action = "purge"
+    ActionImport Action = "import"
+    ActionFail Action = "fail"
+    ActionRecover Action = "recover"
+    ActionRecompress Action = "recompress"
+)
+
+// Change describes a mutation of the catalog. Before is nil for created
+// images and After is nil for purged images.
+type Change struct {
+    Action Action
+    Uuid string
+    Actor string
+    Time time.Time
+    Before *Manifest
+    After *Manifest
+}
+
+// Listener is called for every change after it has been saved to disk.
+// Listeners are called with the pool locked and must not call back into the pool.
+type Listener func(*Change)
+
+func (self *Pool) Listen(listener Listener) {
+    self.lock()
+    defer self.unlock()
+
+    self.listeners = append(self.listeners, listener)
+}
+
+// notify must be called with the pool locked
+func (self *Pool) notify(action Action, actor, uuid string, before, after *Manifest) {
+    change := &Change{
+        Action: action,
+        Uuid: uuid,
+        Actor: actor,
+        Time: time.Now(),
+        Before: before,
+        After: after.clone(),
+    }
+
+    for _, listener := range self.listeners {
+        listener(change)
+    }
+}
+
+// clone returns a deep copy of the manifest, nil is returned for a nil manifest
+func (self *Manifest) clone() *Manifest {
+    if self == nil {
+        return nil
+    }
+
+    data, err := json.Marshal(self)
+    if err != nil {
+        panic(err)
+    }
+
+    m := &Manifest{}
+    if err := json.Unmarshal(data, m); err != nil {
+        panic(err)
+    }
+    return m
+}
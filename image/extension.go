@@ -0,0 +1,155 @@
+package image
+
+import (
+    "sort"
+    "bytes"
+    "reflect"
+    "strings"
+    "encoding/json"
+)
+
+// manifestFields has the fields of Manifest without its json methods
+type manifestFields Manifest
+
+// requirementsFields has the fields of Requirements without its json methods
+type requirementsFields Requirements
+
+// knownFields holds the json names of the Manifest fields
+var knownFields = jsonFields(reflect.TypeOf(Manifest{}))
+
+// knownRequirements holds the json names of the Requirements fields
+var knownRequirements = jsonFields(reflect.TypeOf(Requirements{}))
+
+// jsonFields returns the json names of the fields of the struct type t
+func jsonFields(t reflect.Type) map[string]bool {
+    known := make(map[string]bool)
+
+    for i := 0; i < t.NumField(); i++ {
+        name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+        if name != "" && name != "-" {
+            known[name] = true
+        }
+    }
+
+    return known
+}
+
+// UnmarshalJSON decodes the manifest and keeps the fields it doesn't know
+// about in Extra, so they survive being stored and served again. Numbers
+// in traits are kept as json.Number so they aren't rounded.
+func (self *Manifest) UnmarshalJSON(data []byte) error {
+    if err := decodeJSON(data, (*manifestFields)(self)); err != nil {
+        return err
+    }
+
+    extra, err := unknownFields(data, knownFields)
+    if err != nil {
+        return err
+    }
+
+    self.Extra = extra
+    return nil
+}
+
+// MarshalJSON encodes the manifest with the fields in Extra added
+// after the known ones
+func (self *Manifest) MarshalJSON() ([]byte, error) {
+    data, err := json.Marshal((*manifestFields)(self))
+    if err != nil {
+        return nil, err
+    }
+
+    return addFields(data, self.Extra, knownFields)
+}
+
+// UnmarshalJSON decodes the requirements and keeps the ones it doesn't
+// know about in Extra, like Manifest does
+func (self *Requirements) UnmarshalJSON(data []byte) error {
+    if err := decodeJSON(data, (*requirementsFields)(self)); err != nil {
+        return err
+    }
+
+    extra, err := unknownFields(data, knownRequirements)
+    if err != nil {
+        return err
+    }
+
+    self.Extra = extra
+    return nil
+}
+
+// MarshalJSON encodes the requirements with the ones in Extra added
+// after the known ones
+func (self *Requirements) MarshalJSON() ([]byte, error) {
+    data, err := json.Marshal((*requirementsFields)(self))
+    if err != nil {
+        return nil, err
+    }
+
+    return addFields(data, self.Extra, knownRequirements)
+}
+
+// unknownFields returns the fields of the json object in data that are
+// not known, nil is returned if there are none
+func unknownFields(data []byte, known map[string]bool) (map[string]json.RawMessage, error) {
+    fields := make(map[string]json.RawMessage)
+    if err := json.Unmarshal(data, &fields); err != nil {
+        return nil, err
+    }
+
+    var extra map[string]json.RawMessage
+    for name, value := range fields {
+        if known[name] {
+            continue
+        }
+
+        if extra == nil {
+            extra = make(map[string]json.RawMessage)
+        }
+        extra[name] = value
+    }
+
+    return extra, nil
+}
+
+// addFields adds the extra fields that are not known to the encoded json
+// object in data, sorted by name
+func addFields(data []byte, extra map[string]json.RawMessage, known map[string]bool) ([]byte, error) {
+    names := make([]string, 0, len(extra))
+    for name := range extra {
+        if !known[name] {
+            names = append(names, name)
+        }
+    }
+
+    if len(names) == 0 {
+        return data, nil
+    }
+    sort.Strings(names)
+
+    // Splice the extra fields in before the closing brace, an empty
+    // object has no fields to separate them from
+    buf := bytes.NewBuffer(data[:len(data) - 1])
+    for i, name := range names {
+        key, err := json.Marshal(name)
+        if err != nil {
+            return nil, err
+        }
+
+        // Compact also checks that the value is valid json
+        value := &bytes.Buffer{}
+        if err := json.Compact(value, extra[name]); err != nil {
+            return nil, err
+        }
+
+        if i > 0 || len(data) > 2 {
+            buf.WriteByte(',')
+        }
+        buf.Write(key)
+        buf.WriteByte(':')
+        buf.Write(value.Bytes())
+    }
+    buf.WriteByte('}')
+
+    return buf.Bytes(), nil
+}
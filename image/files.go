@@ -0,0 +1,122 @@
+package image
+
+import (
+    "fmt"
+    "strconv"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// FileSelector picks one of the files of an image. The first file with
+// Compression is picked if it is set, otherwise the first file with the
+// most preferred of the Preferred compressions the image has a file with,
+// otherwise the file at Index.
+type FileSelector struct {
+    Index int
+    Compression string
+    Preferred []string
+}
+
+// ParseFileSelector returns the selector for the compression and index
+// query parameters, both are optional
+func ParseFileSelector(compression, index string) (FileSelector, errors.Error) {
+    sel := FileSelector{Compression: compression}
+
+    if index != "" {
+        i, err := strconv.Atoi(index)
+        if err != nil || i < 0 {
+            return sel, errors.InvalidParameter(err)
+        }
+        sel.Index = i
+    }
+
+    return sel, nil
+}
+
+// SelectFile returns the index of the file picked by sel
+func SelectFile(files []*ImageFile, sel FileSelector) (int, errors.Error) {
+    if len(files) == 0 {
+        err := fmt.Errorf("Manifest has no files")
+        return 0, errors.ResourceNotFound(err)
+    }
+
+    if sel.Compression != "" {
+        for i, file := range files {
+            if file.Compression == sel.Compression {
+                return i, nil
+            }
+        }
+        err := fmt.Errorf("Image has no file with compression %s", sel.Compression)
+        return 0, errors.ResourceNotFound(err)
+    }
+
+    for _, compression := range sel.Preferred {
+        for i, file := range files {
+            if file.Compression == compression {
+                return i, nil
+            }
+        }
+    }
+
+    if sel.Index >= len(files) {
+        err := fmt.Errorf("Image has no file with index %d", sel.Index)
+        return 0, errors.ResourceNotFound(err)
+    }
+
+    return sel.Index, nil
+}
+
+// selectedFile returns a copy of the file of manifest picked by sel
+func (self *Pool) selectedFile(manifest *Manifest, sel FileSelector) (*ImageFile, errors.Error) {
+    self.lock()
+    defer self.unlock()
+
+    index, err := SelectFile(manifest.Files, sel)
+    if err != nil {
+        return nil, err
+    }
+
+    file := *manifest.Files[index]
+    return &file, nil
+}
+
+// uploadIndex returns the index an uploaded file is stored at. Without an
+// index it replaces the file with the same compression or is appended.
+func uploadIndex(files []*ImageFile, compression string, index int) (int, errors.Error) {
+    if index < 0 {
+        for i, file := range files {
+            if file.Compression == compression {
+                return i, nil
+            }
+        }
+        return len(files), nil
+    }
+
+    // Files can be replaced or appended, but there can't be gaps
+    if index > len(files) {
+        err := fmt.Errorf("File index %d is past the end of the %d files", index, len(files))
+        return 0, errors.InvalidParameter(err)
+    }
+
+    return index, nil
+}
+
+// setFile returns a copy of files with file stored at index
+func setFile(files []*ImageFile, index int, file *ImageFile) []*ImageFile {
+    updated := append([]*ImageFile{}, files...)
+    if index == len(updated) {
+        return append(updated, file)
+    }
+
+    updated[index] = file
+    return updated
+}
+
+// hasFile returns true if m has a file with the given sha1
+func (self *Manifest) hasFile(sha1sum string) bool {
+    for _, file := range self.Files {
+        if file.Sha1 == sha1sum {
+            return true
+        }
+    }
+    return false
+}
@@ -46,8 +46,9 @@ func StateFilter(str string) Filter {
     var filter Filter
 
     if str == "all" {
+        // Images in the trash are only listed when asked for explicitly
         filter = func(m *Manifest) bool {
-            return true
+            return m.State != StateDeleted
         }
     } else {
         state := ManifestState(str)
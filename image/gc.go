@@ -0,0 +1,200 @@
+package image
+
+import (
+    "os"
+    "sort"
+    "time"
+    "strings"
+    "path/filepath"
+)
+
+const (
+    // Files younger than this may belong to an upload or save in progress
+    GCGracePeriod = time.Hour
+)
+
+// GCOptions controls a garbage collection pass. Unactivated images older
+// than MaxAge are stale, zero means they are never stale. Nothing is
+// removed unless RemoveFiles or RemoveImages is set.
+type GCOptions struct {
+    MaxAge time.Duration
+    RemoveFiles bool
+    RemoveImages bool
+    Actor string
+}
+
+// GCReport lists the garbage found by a pass. Files are relative to the
+// data directory and Bytes is their total size. FilesRemoved and
+// ImagesRemoved tell whether the garbage was removed.
+type GCReport struct {
+    Time time.Time `json:"time"`
+    OrphanedFiles []string `json:"orphaned_files"`
+    TempFiles []string `json:"temp_files"`
+    StaleImages []string `json:"stale_images"`
+    Bytes int64 `json:"bytes"`
+    FilesRemoved bool `json:"files_removed"`
+    ImagesRemoved bool `json:"images_removed"`
+}
+
+// GC finds image files that aren't referenced by any manifest, temp files
+// left behind by interrupted manifest saves and stale unactivated images
+func (self *Pool) GC(opts GCOptions) (*GCReport, error) {
+    report := &GCReport{
+        Time: time.Now(),
+        OrphanedFiles: make([]string, 0),
+        TempFiles: make([]string, 0),
+        StaleImages: make([]string, 0),
+        FilesRemoved: opts.RemoveFiles,
+        ImagesRemoved: opts.RemoveImages,
+    }
+
+    expected, stale := self.gcScan(opts.MaxAge)
+
+    orphans, err := oldFiles(self.blobDir, true, func(fpath string) bool {
+        return !expected[fpath]
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // Anything left in the directory used before the blob store, a read
+    // only catalog hasn't moved the files out of it yet
+    legacy, err := oldFiles(self.legacyDir, true, func(fpath string) bool {
+        return !self.readOnly
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    temps, err := oldFiles(self.dataDir, false, func(fpath string) bool {
+        return strings.HasPrefix(filepath.Base(fpath), "." + ManifestsFname)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    for fpath, size := range orphans {
+        report.OrphanedFiles = append(report.OrphanedFiles, fpath)
+        report.Bytes += size
+    }
+
+    for fpath, size := range legacy {
+        report.OrphanedFiles = append(report.OrphanedFiles, fpath)
+        report.Bytes += size
+    }
+
+    for fpath, size := range temps {
+        report.TempFiles = append(report.TempFiles, fpath)
+        report.Bytes += size
+    }
+
+    sort.Strings(report.OrphanedFiles)
+    sort.Strings(report.TempFiles)
+
+    if opts.RemoveFiles {
+        for _, fpath := range report.OrphanedFiles {
+            self.removeOrphan(fpath)
+        }
+
+        for _, fpath := range report.TempFiles {
+            os.Remove(fpath)
+        }
+    }
+
+    for _, uuid := range stale {
+        if opts.RemoveImages {
+            // The image may have been deleted in the meantime
+            if err := self.Delete(uuid, opts.Actor); err != nil {
+                continue
+            }
+        }
+        report.StaleImages = append(report.StaleImages, uuid)
+    }
+
+    // Report paths relative to the data directory
+    for i, fpath := range report.OrphanedFiles {
+        report.OrphanedFiles[i], _ = filepath.Rel(self.dataDir, fpath)
+    }
+    for i, fpath := range report.TempFiles {
+        report.TempFiles[i], _ = filepath.Rel(self.dataDir, fpath)
+    }
+
+    return report, nil
+}
+
+// removeOrphan removes an orphaned file unless a manifest
+// started referencing it since the scan
+func (self *Pool) removeOrphan(fpath string) {
+    self.lock()
+    defer self.unlock()
+
+    sha1sum := strings.TrimSuffix(filepath.Base(fpath), ".md5")
+    if fpath == self.blobFpath(sha1sum) || fpath == self.blobMd5Fpath(sha1sum) {
+        if self.blobReferenced(sha1sum) {
+            return
+        }
+    }
+
+    os.Remove(fpath)
+}
+
+// gcScan returns the paths of the blobs referenced by the manifests and
+// the uuids of the unactivated images created more than maxAge ago
+func (self *Pool) gcScan(maxAge time.Duration) (map[string]bool, []string) {
+    self.lock()
+    defer self.unlock()
+
+    expected := make(map[string]bool)
+    stale := make([]string, 0)
+
+    for _, m := range self.manifests {
+        for _, file := range m.Files {
+            expected[self.blobFpath(file.Sha1)] = true
+            expected[self.blobMd5Fpath(file.Sha1)] = true
+        }
+
+        if maxAge <= 0 || m.State != StateUnactivated {
+            continue
+        }
+
+        // Images created before the creation time was recorded are kept
+        created, err := time.Parse(time.RFC3339, m.CreatedAt)
+        if err == nil && time.Since(created) > maxAge {
+            stale = append(stale, m.Uuid)
+        }
+    }
+
+    return expected, stale
+}
+
+// oldFiles returns the paths and sizes of the regular files in dir that
+// match and have not been modified within the grace period
+func oldFiles(dir string, recursive bool, match func(fpath string) bool) (map[string]int64, error) {
+    files := make(map[string]int64)
+
+    err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+        if os.IsNotExist(err) {
+            return nil
+        } else if err != nil {
+            return err
+        }
+
+        if info.IsDir() {
+            if fpath != dir && !recursive {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+
+        if !info.Mode().IsRegular() || !match(fpath) {
+            return nil
+        }
+
+        if time.Since(info.ModTime()) >= GCGracePeriod {
+            files[fpath] = info.Size()
+        }
+        return nil
+    })
+
+    return files, err
+}
@@ -0,0 +1,62 @@
+package image
+
+import (
+    "io"
+    "fmt"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// Import adds a manifest from another image server together with its image
+// file at index. The manifest is kept as is, except for the file at index
+// which is replaced with the metadata of the written file. The image file is
+// only accepted if its sha1 matches the one in the manifest. Other files of
+// images with a source can be added later with RestoreFile.
+func (self *Pool) Import(m *Manifest, index int, reader io.Reader, actor string) errors.Error {
+    if m.Uuid == "" || index < 0 || index >= len(m.Files) {
+        err := fmt.Errorf("Imported manifests must have an uuid and a file at index %d", index)
+        return errors.ValidationFailed(err)
+    }
+
+    if len(m.Files) > 1 && m.Source == "" {
+        err := fmt.Errorf("Imported manifests without a source must have exactly one file")
+        return errors.ValidationFailed(err)
+    }
+
+    if err := validateFiles(m.Files); err != nil {
+        return err
+    }
+
+    if _, ok := self.findManifest(m.Uuid); ok {
+        return errors.ImageUuidAlreadyExists(nil)
+    }
+
+    file := m.Files[index]
+
+    _, err := self.writeFile(file.Compression, reader, file.Sha1, func(imageFile *ImageFile) errors.Error {
+        // Another import of the same image may have finished in the meantime
+        for _, existing := range self.manifests {
+            if existing.Uuid == m.Uuid {
+                return errors.ImageUuidAlreadyExists(nil)
+            }
+        }
+
+        m.Files = setFile(m.Files, index, imageFile)
+        manifests := append(self.manifests, m)
+
+        // Save manifests to disk
+        if err := self.saveManifests(manifests); err != nil {
+            return errors.InternalError(err)
+        }
+
+        self.manifests = manifests
+
+        self.notify(ActionImport, actor, m.Uuid, nil, m)
+
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
@@ -0,0 +1,28 @@
+package image
+
+import (
+    "os"
+    "fmt"
+    "path/filepath"
+)
+
+const LockFname = "smartimages.lock"
+
+// LockDataDir takes the lock on dataDir that is held by the server for as
+// long as it runs, so commands that would race with it can be refused.
+// The lock is held until the returned file is closed.
+func LockDataDir(dataDir string) (*os.File, error) {
+    fpath := filepath.Join(dataDir, LockFname)
+
+    f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0660)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := lockFile(f); err != nil {
+        f.Close()
+        return nil, fmt.Errorf("%s is in use by another smartimages process", dataDir)
+    }
+
+    return f, nil
+}
@@ -0,0 +1,12 @@
+// +build windows
+
+package image
+
+import (
+    "os"
+)
+
+// lockFile does nothing, the data dir isn't locked on windows
+func lockFile(f *os.File) error {
+    return nil
+}
@@ -1,5 +1,9 @@
 package image
 
+import (
+    "encoding/json"
+)
+
 const (
     ManifestVersion = 2
 )
@@ -10,6 +14,12 @@ const (
     StateActive ManifestState = "active"
     StateUnactivated ManifestState = "unactivated"
     StateDisabled ManifestState = "disabled"
+    // Image file is being uploaded
+    StateCreating ManifestState = "creating"
+    // Image file is corrupt or missing
+    StateFailed ManifestState = "failed"
+    // Image is in the trash and purged when the retention expires
+    StateDeleted ManifestState = "deleted"
 )
 
 type Manifest struct {
@@ -35,6 +45,33 @@ type Manifest struct {
     
     // Optional
     Description string `json:"description"`
+    Homepage string `json:"homepage,omitempty"`
+    Eula string `json:"eula,omitempty"`
+    Urn string `json:"urn,omitempty"`
+    Requirements *Requirements `json:"requirements,omitempty"`
+    GeneratePasswords *bool `json:"generate_passwords,omitempty"`
+    Users []*ImageUser `json:"users,omitempty"`
+    InheritedDirectories []string `json:"inherited_directories,omitempty"`
+    BillingTags []string `json:"billing_tags,omitempty"`
+    Traits map[string]interface{} `json:"traits,omitempty"`
+
+    // Set while the image is failed
+    Error *ManifestError `json:"error,omitempty"`
+
+    // Url of the image server the image was imported from
+    Source string `json:"source,omitempty"`
+
+    // Set for images cached by the proxy, their files may be evicted
+    Cached bool `json:"cached,omitempty"`
+
+    // Time the image was created, used to collect stale unactivated images
+    CreatedAt string `json:"created_at,omitempty"`
+
+    // Time the image was moved to the trash
+    DeletedAt string `json:"deleted_at,omitempty"`
+
+    // Fields this version doesn't know about, kept as they were
+    Extra map[string]json.RawMessage `json:"-"`
 }
 
 type ImageFile struct {
@@ -42,3 +79,36 @@ type ImageFile struct {
     Size int64 `json:"size"`
     Compression string `json:"compression"`
 }
+
+// Requirements describes what a vm needs to be provisioned with the image,
+// platforms map an SDC version to the minimum or maximum platform image
+type Requirements struct {
+    Networks []*RequirementNetwork `json:"networks,omitempty"`
+    Brand string `json:"brand,omitempty"`
+    SshKey *bool `json:"ssh_key,omitempty"`
+    MinRam int64 `json:"min_ram,omitempty"`
+    MaxRam int64 `json:"max_ram,omitempty"`
+    MinPlatform map[string]string `json:"min_platform,omitempty"`
+    MaxPlatform map[string]string `json:"max_platform,omitempty"`
+    Bootrom string `json:"bootrom,omitempty"`
+
+    // Requirements this version doesn't know about, kept as they were
+    Extra map[string]json.RawMessage `json:"-"`
+}
+
+type RequirementNetwork struct {
+    Name string `json:"name"`
+    Description string `json:"description"`
+}
+
+// ImageUser is a user of the image, the passwords of which
+// are generated on provisioning if generate_passwords is set
+type ImageUser struct {
+    Name string `json:"name"`
+}
+
+// ManifestError describes why an image is failed
+type ManifestError struct {
+    Code string `json:"code"`
+    Message string `json:"message"`
+}
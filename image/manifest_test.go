@@ -0,0 +1,105 @@
+package image
+
+import (
+    "testing"
+    "encoding/json"
+)
+
+// v2 manifest of a kvm image using every field imgapi knows about,
+// requirements.vcpus stands in for a requirement added later
+const sampleKvm = `{
+    "v": 2,
+    "uuid": "7d1d6a3c-4a6b-11e5-9ac1-3b7d1ea0c3a5",
+    "owner": "930896af-bf8c-48d4-885c-6573a94b1853",
+    "name": "ubuntu-certified-14.04",
+    "version": "20150819",
+    "state": "active",
+    "disabled": false,
+    "public": true,
+    "published_at": "2015-08-20T12:51:44Z",
+    "type": "zvol",
+    "os": "linux",
+    "files": [
+        {
+            "sha1": "0b3e4d2f16a1c0f6e3b2dd0f3a8c3a2d51e61bfb",
+            "size": 287237810,
+            "compression": "gzip"
+        }
+    ],
+    "description": "Ubuntu 14.04 LTS (20150819 64-bit). Certified Ubuntu Server Cloud Image from Canonical.",
+    "homepage": "https://docs.joyent.com/images/linux/ubuntu-certified",
+    "eula": "https://www.ubuntu.com/legal/terms-and-policies",
+    "urn": "sdc:canonical:ubuntu-certified-14.04:20150819",
+    "requirements": {
+        "networks": [{"name": "net0", "description": "public"}],
+        "brand": "kvm",
+        "ssh_key": false,
+        "min_ram": 512,
+        "max_ram": 65536,
+        "min_platform": {"7.0": "20141030T081701Z"},
+        "max_platform": {"7.0": "20991231T000000Z"},
+        "bootrom": "bios",
+        "vcpus": {"min": 1, "max": 16}
+    },
+    "nic_driver": "virtio",
+    "disk_driver": "virtio",
+    "cpu_type": "host",
+    "image_size": 10240,
+    "generate_passwords": false,
+    "users": [{"name": "root"}, {"name": "ubuntu"}],
+    "inherited_directories": ["/opt"],
+    "billing_tags": ["ubuntu", "certified"],
+    "traits": {"ssd": true},
+    "tags": {"role": "os"}
+}`
+
+func TestManifestRoundTrip(t *testing.T) {
+    m := &Manifest{}
+    if err := json.Unmarshal([]byte(sampleKvm), m); err != nil {
+        t.Fatal(err)
+    }
+
+    // Stored and served manifests go through clone as well
+    data, err := json.Marshal(m.clone())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    checkFields(t, decodeRaw(t, []byte(sampleKvm)), decodeRaw(t, data))
+}
+
+func TestRequirementsSshKey(t *testing.T) {
+    for _, sample := range []string{`{}`, `{"ssh_key":false}`, `{"ssh_key":true}`} {
+        req := &Requirements{}
+        if err := json.Unmarshal([]byte(sample), req); err != nil {
+            t.Fatal(err)
+        }
+
+        data, err := json.Marshal(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if string(data) != sample {
+            t.Errorf("Requirements %s encoded as %s", sample, data)
+        }
+    }
+}
+
+func TestRequirementsKeepUnknown(t *testing.T) {
+    sample := `{"vcpus":{"min":1,"max":16}}`
+
+    req := &Requirements{}
+    if err := json.Unmarshal([]byte(sample), req); err != nil {
+        t.Fatal(err)
+    }
+
+    data, err := json.Marshal(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if string(data) != sample {
+        t.Errorf("Requirements %s encoded as %s", sample, data)
+    }
+}
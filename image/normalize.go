@@ -0,0 +1,42 @@
+package image
+
+import (
+    "fmt"
+)
+
+// normalizeManifest makes the state of m agree with its other fields.
+// The state wins over the disabled flag since it is what the pool acts
+// on. A description of every correction made is returned.
+func normalizeManifest(m *Manifest) []string {
+    corrections := make([]string, 0)
+
+    switch m.State {
+    case StateActive, StateUnactivated, StateDisabled, StateFailed, StateDeleted:
+    case StateCreating:
+        // Uploads don't survive a restart, the image file has to be uploaded again
+        corrections = append(corrections, "interrupted upload, state set to unactivated")
+        m.State = StateUnactivated
+    default:
+        state := restoredState(m)
+        corrections = append(corrections, fmt.Sprintf("unknown state %q, state set to %s", m.State, state))
+        m.State = state
+    }
+
+    // Only activated images can be enabled
+    disabled := m.Disabled
+    switch m.State {
+    case StateActive:
+        disabled = false
+    case StateUnactivated, StateDisabled:
+        disabled = true
+    case StateFailed, StateDeleted:
+        disabled = m.Disabled || m.PublishedAt == ""
+    }
+
+    if disabled != m.Disabled {
+        corrections = append(corrections, fmt.Sprintf("disabled set to %t to match state %s", disabled, m.State))
+        m.Disabled = disabled
+    }
+
+    return corrections
+}
@@ -8,81 +8,215 @@ import (
     "os"
     "encoding/json"
     "path/filepath"
-    "crypto/sha1"
-    "crypto/md5"
     "io/ioutil"
     "code.google.com/p/go-uuid/uuid"
     "github.com/prasmussen/smartimages/errors"
+    "github.com/prasmussen/smartimages/atomicfile"
+    "github.com/prasmussen/smartimages/metrics"
+    "github.com/prasmussen/smartimages/log"
 )
 
 const (
     ManifestsFname = "manifests.json"
+    BlobDirName = "blobs"
+    // Image files were stored per uuid in this directory before the blob store
+    ImageDirName = "images"
 )
 
 var FileExtensions = map[string]string{
     "bzip2": "bz2",
     "gzip": "gz",
     "none": "raw",
+    "xz": "xz",
 }
 
 type FileMetadata struct {
     Md5sum []byte
     Size int64
+    Sha1 string
+    Compression string
 }
 
 type Pool struct {
-    imageDir string
+    dataDir string
+    blobDir string
+    legacyDir string
+    manifestsFpath string
     manifests []*Manifest
+    uploads *uploads
+    metrics *metrics.Metrics
+    logger *log.Logger
+    listeners []Listener
+    readOnly bool
+    lockFile *os.File
     mutex *sync.Mutex
 }
 
-func NewImagePool(imageDir string) *Pool {
-    return &Pool{
-        imageDir: imageDir,
-        manifests: loadManifests(),
+// NewImagePool loads the image catalog stored in dataDir. Image files are
+// kept in the blobs subdirectory, next to the manifests file. The data dir
+// is locked for as long as the process runs.
+func NewImagePool(dataDir string, m *metrics.Metrics, logger *log.Logger) (*Pool, error) {
+    // Create data directory if it does not exist
+    if err := os.MkdirAll(dataDir, 0775); err != nil {
+        return nil, err
+    }
+
+    lockFile, err := LockDataDir(dataDir)
+    if err != nil {
+        return nil, err
+    }
+
+    pool, corrected, err := openImagePool(dataDir, m, logger)
+    if err != nil {
+        lockFile.Close()
+        return nil, err
+    }
+    pool.lockFile = lockFile
+
+    moved, err := pool.migrateFiles()
+    if err != nil {
+        lockFile.Close()
+        return nil, fmt.Errorf("Failed to move image files to %s: %s", pool.blobDir, err)
+    } else if moved > 0 {
+        logger.Infof("Moved %d image files to %s", moved, pool.blobDir)
+    }
+
+    // Keep the corrections so they are only reported once
+    if corrected > 0 {
+        if err := pool.saveManifests(pool.manifests); err != nil {
+            lockFile.Close()
+            return nil, fmt.Errorf("Failed to save corrected manifests: %s", err)
+        }
+    }
+
+    return pool, nil
+}
+
+// OpenImagePool loads the image catalog stored in dataDir read only, for
+// commands that run next to the server. Corrections are not saved, image
+// files are not moved and changes to the catalog fail.
+func OpenImagePool(dataDir string, m *metrics.Metrics, logger *log.Logger) (*Pool, error) {
+    pool, _, err := openImagePool(dataDir, m, logger)
+    if err != nil {
+        return nil, err
+    }
+
+    pool.readOnly = true
+    return pool, nil
+}
+
+// openImagePool loads the catalog and returns the number of manifests
+// that were corrected while loading
+func openImagePool(dataDir string, m *metrics.Metrics, logger *log.Logger) (*Pool, int, error) {
+    manifestsFpath := filepath.Join(dataDir, ManifestsFname)
+
+    if err := checkLegacyCatalog(manifestsFpath); err != nil {
+        return nil, 0, err
+    }
+
+    manifests, corrected, err := loadManifests(manifestsFpath, logger)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    pool := &Pool{
+        dataDir: dataDir,
+        blobDir: filepath.Join(dataDir, BlobDirName),
+        legacyDir: filepath.Join(dataDir, ImageDirName),
+        manifestsFpath: manifestsFpath,
+        manifests: manifests,
+        uploads: newUploads(),
+        metrics: m,
+        logger: logger,
         mutex: &sync.Mutex{},
     }
+
+    return pool, corrected, nil
 }
 
-func loadManifests() []*Manifest {
-    manifests := make([]*Manifest, 0)
+// checkLegacyCatalog refuses to start with an empty catalog while the
+// manifests are still in the working directory, where versions before the
+// data dir kept them
+func checkLegacyCatalog(manifestsFpath string) error {
+    if _, err := os.Stat(manifestsFpath); err == nil {
+        return nil
+    }
 
-    f, err := os.Open(ManifestsFname)
+    legacyFpath, err := filepath.Abs(ManifestsFname)
     if err != nil {
-        return manifests
+        return nil
     }
 
-    defer f.Close()
+    if abs, err := filepath.Abs(manifestsFpath); err != nil || abs == legacyFpath {
+        return nil
+    }
 
-    json.NewDecoder(f).Decode(&manifests)
-    return manifests
+    if _, err := os.Stat(legacyFpath); err == nil {
+        return fmt.Errorf("Found %s but no %s, move it into the data dir before starting", legacyFpath, manifestsFpath)
+    }
+
+    return nil
 }
 
-func saveManifests(manifests []*Manifest) error {
-    // Grab a temp file
-    f, err := ioutil.TempFile(".", "." + ManifestsFname)
-    if err != nil {
-        return err
+// loadManifests reads the catalog, upgrades manifests written in older
+// versions and normalizes them. The number of corrections made is
+// returned along with them.
+func loadManifests(fpath string, logger *log.Logger) ([]*Manifest, int, error) {
+    manifests := make([]*Manifest, 0)
+    entries := make([]json.RawMessage, 0)
+
+    f, err := os.Open(fpath)
+    if os.IsNotExist(err) {
+        // Start with an empty catalog
+        return manifests, 0, nil
+    } else if err != nil {
+        return nil, 0, err
     }
 
-    // Close temp file on function exit its not already closed
     defer f.Close()
 
-    // Write manifests to temp file
-    if err := json.NewEncoder(f).Encode(manifests); err != nil {
-        return err
+    // Refuse to start with a broken catalog, the next save would overwrite it
+    if err := json.NewDecoder(f).Decode(&entries); err != nil {
+        return nil, 0, fmt.Errorf("Failed to parse %s: %s", fpath, err)
     }
 
-    // Close temp file
-    f.Close()
+    // Report what was corrected so hand edits that didn't stick are noticed
+    corrected := 0
+    for i, entry := range entries {
+        m, version, err := DecodeManifest(entry)
+        if err != nil {
+            return nil, 0, fmt.Errorf("Failed to parse manifest %d in %s: %s", i, fpath, err)
+        }
 
-    // Overwrite the old manifests file with the new one
-    // Which is an atomic operation on sane OS's
-    if err := os.Rename(f.Name(), ManifestsFname); err != nil {
-        return err
+        corrections := normalizeManifest(m)
+        if version != ManifestVersion {
+            corrections = append([]string{fmt.Sprintf("upgraded from v%d to v%d", version, ManifestVersion)}, corrections...)
+        }
+
+        manifests = append(manifests, m)
+
+        for _, correction := range corrections {
+            logger.Infof("Corrected manifest %s: %s", m.Uuid, correction)
+            corrected++
+        }
     }
 
-    return nil
+    return manifests, corrected, nil
+}
+
+func (self *Pool) saveManifests(manifests []*Manifest) error {
+    if self.readOnly {
+        return fmt.Errorf("The image catalog is opened read only")
+    }
+
+    start := time.Now()
+    defer func() {
+        self.metrics.ManifestSaveDuration.Observe(metrics.Since(start))
+    }()
+
+    return atomicfile.Write(self.manifestsFpath, func(w io.Writer) error {
+        return json.NewEncoder(w).Encode(manifests)
+    })
 }
 
 func (self *Pool) Get(uuid string) (*Manifest, errors.Error) {
@@ -94,41 +228,60 @@ func (self *Pool) Get(uuid string) (*Manifest, errors.Error) {
     return manifest, nil
 }
 
-func (self *Pool) GetFile(uuid string) (io.ReadCloser, *FileMetadata, errors.Error) {
+// GetFile opens the image file picked by sel
+func (self *Pool) GetFile(uuid string, sel FileSelector) (io.ReadCloser, *FileMetadata, errors.Error) {
     manifest, ok := self.findManifest(uuid)
     if !ok {
         err := fmt.Errorf("Manifest not found")
         return nil, nil, errors.ResourceNotFound(err)
     }
 
-    if len(manifest.Files) == 0 {
-        err := fmt.Errorf("Manifest has no files")
+    file, selectErr := self.selectedFile(manifest, sel)
+    if selectErr != nil {
+        return nil, nil, selectErr
+    }
+
+    // Images in the trash are gone as far as clients are concerned
+    if manifest.State == StateDeleted {
+        err := fmt.Errorf("Image is deleted")
         return nil, nil, errors.ResourceNotFound(err)
     }
 
-    // Find image extension by compression type
-    compression := manifest.Files[0].Compression
-    ext := FileExtensions[compression]
+    // Never serve a file that failed verification
+    if manifest.State == StateFailed {
+        err := fmt.Errorf("Image file failed verification")
+        return nil, nil, errors.ResourceNotFound(err)
+    }
 
     // Find absolute path for image and md5file
-    imageFpath := filepath.Join(self.imageDir, fmt.Sprintf("%s.%s", uuid, ext))
-    md5Fpath := filepath.Join(self.imageDir, uuid + ".md5")
+    imageFpath := self.blobFpath(file.Sha1)
+    md5Fpath := self.blobMd5Fpath(file.Sha1)
 
-    // Read md5 sum from file
-    md5sum, err := ioutil.ReadFile(md5Fpath)
-    if err != nil {
+    // Open file, it may have been evicted from the cache
+    f, err := os.Open(imageFpath)
+    if os.IsNotExist(err) {
+        err := fmt.Errorf("Image file not found")
+        return nil, nil, errors.ResourceNotFound(err)
+    } else if err != nil {
         return nil, nil, errors.InternalError(err)
     }
 
-    // Open file
-    f, err := os.Open(imageFpath)
+    // Read md5 sum from file
+    md5sum, err := ioutil.ReadFile(md5Fpath)
     if err != nil {
+        f.Close()
         return nil, nil, errors.InternalError(err)
     }
 
+    // Mark file as recently used for the cache eviction
+    now := time.Now()
+    os.Chtimes(imageFpath, now, now)
+
     metadata := &FileMetadata{
         Md5sum: md5sum,
-        Size: manifest.Files[0].Size,
+        Size: file.Size,
+        Sha1: file.Sha1,
+        Compression: file.Compression,
     }
 
     return f, metadata, nil
@@ -149,30 +302,82 @@ func (self *Pool) List(filters []Filter) []*Manifest {
     return manifests
 }
 
-func (self *Pool) Create(m *Manifest) errors.Error {
+// ListCopies is like List but returns copies of the manifests taken under
+// the lock, for callers that read them while the pool may change them
+func (self *Pool) ListCopies(filters []Filter) []*Manifest {
+    self.lock()
+    defer self.unlock()
+
+    manifests := make([]*Manifest, 0)
+
+    for _, m := range self.manifests {
+        if MatchManifest(filters, m) {
+            manifests = append(manifests, m.clone())
+        }
+    }
+
+    return manifests
+}
+
+func (self *Pool) CountByState() map[ManifestState]int {
+    self.lock()
+    defer self.unlock()
+
+    counts := make(map[ManifestState]int)
+    for _, m := range self.manifests {
+        counts[m.State]++
+    }
+
+    return counts
+}
+
+func (self *Pool) Create(m *Manifest, actor string) errors.Error {
+    if err := m.validate(); err != nil {
+        return err
+    }
+
     m.V = ManifestVersion
     m.Uuid = uuid.NewUUID().String()
     m.State = StateUnactivated
     m.Disabled = true
     m.Public = true
     m.Files = make([]*ImageFile, 0)
+    m.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+    // Fields the pool maintains itself, a client must not preset them
+    m.Source = ""
+    m.Cached = false
+    m.Error = nil
+    m.DeletedAt = ""
 
-    if err := self.addManifest(m); err != nil {
+    if err := self.addManifest(m, actor); err != nil {
         return errors.InternalError(err)
     }
 
     return nil
 }
 
-func (self *Pool) Delete(uuid string) errors.Error {
+// Purge permanently removes the image, its file is removed
+// unless another image shares it
+func (self *Pool) Purge(uuid, actor string) errors.Error {
+    return self.purgeIf(uuid, actor, nil)
+}
+
+// purgeIf purges the image if cond is nil or returns true for its manifest
+func (self *Pool) purgeIf(uuid, actor string, cond func(*Manifest) bool) errors.Error {
     // Find manifest with matching uuid
-    _, ok := self.findManifest(uuid)
+    manifest, ok := self.findManifest(uuid)
     if !ok {
         return errors.ResourceNotFound(nil)
     }
 
     self.lock()
 
+    if cond != nil && !cond(manifest) {
+        self.unlock()
+        return errors.ValidationFailed(nil)
+    }
+
     // Remove manifest from internal slice first
     manifests := make([]*Manifest, 0)
     for _, m := range self.manifests {
@@ -183,108 +388,75 @@ func (self *Pool) Delete(uuid string) errors.Error {
     self.manifests = manifests
 
     // Save manifests to disk
-    if err := saveManifests(self.manifests); err != nil {
+    if err := self.saveManifests(self.manifests); err != nil {
+        self.unlock()
         return errors.InternalError(err)
     }
 
-    // No need to keep lock anymore
-    self.unlock()
+    self.notify(ActionPurge, actor, uuid, manifest.clone(), nil)
 
-    // Find all files starting with the uuid of the image
-    pattern := filepath.Join(self.imageDir, uuid + ".*")
-    matches, err := filepath.Glob(pattern)
-    if err != nil {
-        return errors.InternalError(err)
-    }
+    // Delete the image files unless another image shares them
+    self.releaseFiles(manifest.Files)
 
-    // Delete files
-    for _, fname := range matches {
-        os.Remove(fname)
-    }
+    self.unlock()
 
     return nil
 }
 
-func (self *Pool) AddFile(uuid, compression string, reader io.Reader) (*Manifest, errors.Error) {
+// AddFile writes an image file and stores it at index in the files of the
+// image. With a negative index it replaces the file with the same
+// compression or is added after the other files.
+func (self *Pool) AddFile(uuid, compression string, index int, reader io.Reader, actor string) (*Manifest, errors.Error) {
     // Find manifest with matching uuid
     manifest, ok := self.findManifest(uuid)
     if !ok {
         return nil, errors.ResourceNotFound(nil)
     }
 
-    // Make sure the manifest has the correct state
-    if manifest.State != StateUnactivated {
-        return nil, errors.ImageAlreadyActivated(nil)
-    }
-
-    // Resolve file extension for the given compression type
-    ext, ok := FileExtensions[compression]
-    if !ok {
-        return nil, errors.InvalidParameter(nil)
-    }
-
-    // Find absolute path for image and md5file
-    imageFpath := filepath.Join(self.imageDir, fmt.Sprintf("%s.%s", uuid, ext))
-    md5Fpath := filepath.Join(self.imageDir, uuid + ".md5")
-
-    // Create destination directory if it does not exist
-    err := os.MkdirAll(self.imageDir, 0775)
-    if err != nil {
-        return nil, errors.InternalError(err)
+    // The image stays in the creating state while the file is written,
+    // which keeps it from being activated or uploaded to concurrently
+    self.lock()
+    before := manifest.clone()
+    index, err := uploadIndex(manifest.Files, compression, index)
+    if err == nil {
+        err = manifest.transition(ActionUpload)
     }
-
-    // Open image file
-    f, err := os.Create(imageFpath)
+    self.unlock()
     if err != nil {
-        return nil, errors.InternalError(err)
+        return nil, err
     }
 
-    // Remember to close files
-    defer f.Close()
-
-    // Calcluate sha1 and md5 sum while writing image to disk
-    // Sha1 is a required field in the manifest
-    shaHash := sha1.New()
-    sha1Reader := io.TeeReader(reader, shaHash)
-
-    // Md5 is needed by imgadm client which expects the
-    // content-md5 header to be present
-    md5Hash := md5.New()
-    md5Reader := io.TeeReader(sha1Reader, md5Hash)
-    
-    // Write image to disk
-    nBytes, err := io.Copy(f, md5Reader)
-    if err != nil {
-        return nil, errors.Upload(err)
-    }
+    // Update manifest once the file is in place
+    _, err = self.writeFile(compression, reader, "", func(imageFile *ImageFile) errors.Error {
+        manifest.transition(actionUploaded)
+        manifest.Files = setFile(before.Files, index, imageFile)
 
-    // Write md5sum to file
-    md5sum := md5Hash.Sum(nil)
-    if err := ioutil.WriteFile(md5Fpath, md5sum, 0660); err != nil {
-        return nil, errors.InternalError(err)
-    }
+        // Save manifests to disk
+        if err := self.saveManifests(self.manifests); err != nil {
+            manifest.Files = before.Files
+            return errors.InternalError(err)
+        }
 
-    // Add image file to manifest
-    imageFile := &ImageFile{
-        Sha1: fmt.Sprintf("%x", shaHash.Sum(nil)),
-        Compression: compression,
-        Size: nBytes,
-    }
+        self.notify(ActionUpload, actor, uuid, before, manifest)
 
-    // Update manifest
-    self.lock()
-    defer self.unlock()
-    manifest.Files = []*ImageFile{imageFile}
+        // Delete the replaced file unless another image shares it
+        if index < len(before.Files) {
+            self.releaseBlob(before.Files[index].Sha1)
+        }
 
-    // Save manifests to disk
-    if err := saveManifests(self.manifests); err != nil {
-        return nil, errors.InternalError(err)
+        return nil
+    })
+    if err != nil {
+        self.lock()
+        manifest.State = before.State
+        self.unlock()
+        return nil, err
     }
 
     return manifest, nil
 }
 
-func (self *Pool) Activate(uuid string) (*Manifest, errors.Error) {
+func (self *Pool) Activate(uuid, actor string) (*Manifest, errors.Error) {
     // Find manifest with the given uuid
     manifest, ok := self.findManifest(uuid)
     if !ok {
@@ -296,59 +468,70 @@ func (self *Pool) Activate(uuid string) (*Manifest, errors.Error) {
         return nil, errors.NoActivationNoFile(nil)
     }
 
-    // Make sure it has not been activated before
-    if manifest.State != StateUnactivated {
-        return nil, errors.ImageAlreadyActivated(nil)
-    }
-
     self.lock()
     defer self.unlock()
 
     // Activate image
-    manifest.State = StateActive
+    before := manifest.clone()
+    if err := manifest.transition(ActionActivate); err != nil {
+        return nil, err
+    }
     manifest.Disabled = false
     manifest.PublishedAt = time.Now().Format(time.RFC3339)
 
     // Save manifests to disk
-    if err := saveManifests(self.manifests); err != nil {
+    if err := self.saveManifests(self.manifests); err != nil {
+        manifest.State = before.State
+        manifest.Disabled = before.Disabled
+        manifest.PublishedAt = before.PublishedAt
         return nil, errors.InternalError(err)
     }
 
+    self.notify(ActionActivate, actor, uuid, before, manifest)
+
     return manifest, nil
 }
 
-func (self *Pool) SetDisabled(uuid string, disabled bool) (*Manifest, errors.Error) {
+func (self *Pool) SetDisabled(uuid string, disabled bool, actor string) (*Manifest, errors.Error) {
     // Find manifest with the given uuid
     manifest, ok := self.findManifest(uuid)
     if !ok {
         return nil, errors.ResourceNotFound(nil)
     }
 
-    if !disabled && manifest.State == StateUnactivated {
-        // Image must be activated before it can be enabled
-        return nil, errors.ServiceUnavailableError(nil)
+    action := ActionEnable
+    if disabled {
+        action = ActionDisable
     }
 
     self.lock()
     defer self.unlock()
 
     // Enable / disable the image
-    if disabled {
-        manifest.State = StateDisabled
-    } else {
-        manifest.State = StateActive
+    before := manifest.clone()
+    if err := manifest.transition(action); err != nil {
+        return nil, err
     }
-
     manifest.Disabled = disabled
 
     // Save manifests to disk
-    if err := saveManifests(self.manifests); err != nil {
+    if err := self.saveManifests(self.manifests); err != nil {
+        manifest.State = before.State
+        manifest.Disabled = before.Disabled
         return nil, errors.InternalError(err)
     }
 
+    self.notify(action, actor, uuid, before, manifest)
+
     return manifest, nil
 }
 
+// AbortUploads aborts all in-flight uploads and waits for them to
+// clean up their partial files. New uploads are refused afterwards.
+func (self *Pool) AbortUploads() {
+    self.uploads.abort()
+}
+
 func (self *Pool) findManifest(uuid string) (*Manifest, bool) {
     self.lock()
     defer self.unlock()
@@ -362,20 +545,22 @@ func (self *Pool) findManifest(uuid string) (*Manifest, bool) {
     return nil, false
 }
 
-func (self *Pool) addManifest(m *Manifest) error {
+func (self *Pool) addManifest(m *Manifest, actor string) error {
     self.lock()
     defer self.unlock()
 
     manifests := append(self.manifests, m)
 
     // Save manifests to disk
-    if err := saveManifests(manifests); err != nil {
+    if err := self.saveManifests(manifests); err != nil {
         return err
     }
 
     // Update internal manifests slice
     self.manifests = manifests
 
+    self.notify(ActionCreate, actor, m.Uuid, nil, m)
+
     return nil
 }
 
@@ -0,0 +1,126 @@
+package image
+
+import (
+    "io"
+    "fmt"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// MissingFiles returns the indexes of the image files described by m that
+// are not in the pool yet. Files another image shares are not missing.
+func (self *Pool) MissingFiles(m *Manifest) []int {
+    missing := make([]int, 0)
+    for i, file := range m.Files {
+        if !self.blobExists(file.Sha1) {
+            missing = append(missing, i)
+        }
+    }
+    return missing
+}
+
+// Replicate adds or replaces the manifest of an image with a copy of m as
+// it is on another image server, the change is recorded with the action
+// it had there. If reader is given it is written as the image file at
+// index, which is only accepted if its sha1 matches the one in the
+// manifest. The manifest is only replaced once all its image files are in
+// the pool, so missing files are replicated one call at a time and the
+// last call replaces the manifest.
+func (self *Pool) Replicate(action Action, m *Manifest, index int, reader io.Reader, actor string) errors.Error {
+    if m.Uuid == "" {
+        err := fmt.Errorf("Replicated manifests must have an uuid")
+        return errors.ValidationFailed(err)
+    }
+
+    if err := validateFiles(m.Files); err != nil {
+        return err
+    }
+
+    m = m.clone()
+
+    if reader == nil {
+        self.lock()
+        defer self.unlock()
+
+        if len(self.MissingFiles(m)) > 0 {
+            err := fmt.Errorf("Image file not found")
+            return errors.ResourceNotFound(err)
+        }
+
+        return self.replaceManifest(action, m, actor)
+    }
+
+    if index < 0 || index >= len(m.Files) {
+        err := fmt.Errorf("Manifest has no file at index %d", index)
+        return errors.ValidationFailed(err)
+    }
+
+    // Files written before the last one are unreferenced until the
+    // manifest is replaced, the gc grace period keeps them around
+    file := m.Files[index]
+    _, err := self.writeFile(file.Compression, reader, file.Sha1, func(*ImageFile) errors.Error {
+        if len(self.MissingFiles(m)) > 0 {
+            return nil
+        }
+        return self.replaceManifest(action, m, actor)
+    })
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// ReplicateState replaces the manifest of an image with a copy of m when
+// its image files can't be replicated, the image keeps the files it has.
+// Nothing is done if the image isn't in the pool.
+func (self *Pool) ReplicateState(action Action, m *Manifest, actor string) errors.Error {
+    self.lock()
+    defer self.unlock()
+
+    for _, existing := range self.manifests {
+        if existing.Uuid != m.Uuid {
+            continue
+        }
+
+        updated := m.clone()
+        updated.Files = existing.clone().Files
+        return self.replaceManifest(action, updated, actor)
+    }
+
+    return nil
+}
+
+// replaceManifest adds m or replaces the manifest with the same uuid,
+// the caller must hold the lock
+func (self *Pool) replaceManifest(action Action, m *Manifest, actor string) errors.Error {
+    // Keep the position of an existing manifest
+    var before *Manifest
+    manifests := make([]*Manifest, 0, len(self.manifests) + 1)
+    for _, existing := range self.manifests {
+        if existing.Uuid == m.Uuid {
+            before = existing
+            manifests = append(manifests, m)
+        } else {
+            manifests = append(manifests, existing)
+        }
+    }
+    if before == nil {
+        manifests = append(manifests, m)
+    }
+
+    // Save manifests to disk
+    if err := self.saveManifests(manifests); err != nil {
+        return errors.InternalError(err)
+    }
+
+    self.manifests = manifests
+
+    self.notify(action, actor, m.Uuid, before.clone(), m)
+
+    // Delete the replaced files unless another image shares them
+    if before != nil {
+        self.releaseFiles(before.Files)
+    }
+
+    return nil
+}
@@ -0,0 +1,202 @@
+package image
+
+import (
+    "fmt"
+    "bytes"
+    "strings"
+    "encoding/json"
+)
+
+const (
+    // Oldest manifest version that can be migrated from and to
+    MinManifestVersion = 1
+)
+
+// Manifests are migrated as generic JSON objects, so fields that only
+// exist in one version can be moved around before the Manifest type is
+// involved. Numbers are kept as json.Number so they come out as they went
+// in. Manifests without a version are v1.
+type rawManifest map[string]interface{}
+
+// Fields only this server keeps, other image servers don't know them
+var localFields = []string{"source", "cached", "created_at", "deleted_at"}
+
+// migration converts a manifest between version and version + 1
+type migration struct {
+    version int
+    up func(rawManifest)
+    down func(rawManifest)
+}
+
+// migrations must be ordered by version and cover every version from
+// MinManifestVersion up to ManifestVersion
+var migrations = []migration{
+    {1, upgradeV1, downgradeV2},
+}
+
+// upgradeV1 renames the v1 fields that were replaced in v2 and derives the
+// state and visibility which v1 manifests don't have
+func upgradeV1(m rawManifest) {
+    if owner, ok := m["creator_uuid"]; ok {
+        m["owner"] = owner
+    }
+
+    if created, ok := m["created_at"]; ok {
+        m["published_at"] = created
+    }
+
+    // Restricted images are only visible to the uuid they are restricted to
+    if _, ok := m["public"]; !ok {
+        restricted, ok := m["restricted_to_uuid"].(string)
+        m["public"] = !ok || restricted == ""
+    }
+
+    if _, ok := m["state"]; !ok {
+        if disabled, _ := m["disabled"].(bool); disabled {
+            m["state"] = string(StateDisabled)
+        } else {
+            m["state"] = string(StateActive)
+        }
+    }
+
+    // v1 files have no compression, it is the extension of their path
+    files, _ := m["files"].([]interface{})
+    for _, f := range files {
+        file, ok := f.(map[string]interface{})
+        if !ok || file["compression"] != nil {
+            continue
+        }
+
+        path, _ := file["path"].(string)
+        file["compression"] = "none"
+        for compression, ext := range FileExtensions {
+            if compression != "none" && strings.HasSuffix(path, "." + ext) {
+                file["compression"] = compression
+            }
+        }
+    }
+
+    for _, key := range []string{"creator_uuid", "vendor_uuid", "created_at", "restricted_to_uuid", "platform_type"} {
+        delete(m, key)
+    }
+}
+
+// downgradeV2 reverses upgradeV1, the fields that don't exist in v1
+// are dropped. The local fields go first, created_at means publication
+// time in v1 and not when the image was created here.
+func downgradeV2(m rawManifest) {
+    for _, key := range localFields {
+        delete(m, key)
+    }
+
+    if owner, ok := m["owner"]; ok {
+        m["creator_uuid"] = owner
+    }
+
+    if published, ok := m["published_at"]; ok {
+        m["created_at"] = published
+    }
+
+    if public, ok := m["public"].(bool); ok && !public {
+        m["restricted_to_uuid"] = m["owner"]
+    }
+
+    for _, key := range []string{"owner", "published_at", "public", "state", "error"} {
+        delete(m, key)
+    }
+}
+
+// rawVersion returns the version of the raw manifest
+func rawVersion(m rawManifest) int {
+    number, _ := m["v"].(json.Number)
+    v, err := number.Int64()
+    if err != nil || v == 0 {
+        return 1
+    }
+    return int(v)
+}
+
+// decodeJSON decodes data into v with numbers kept as json.Number
+func decodeJSON(data []byte, v interface{}) error {
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.UseNumber()
+    return decoder.Decode(v)
+}
+
+// migrate converts the raw manifest to the given version
+func migrate(m rawManifest, version int) error {
+    from := rawVersion(m)
+
+    if version < MinManifestVersion || version > ManifestVersion {
+        return fmt.Errorf("Unsupported manifest version %d", version)
+    }
+    if from < MinManifestVersion || from > ManifestVersion {
+        return fmt.Errorf("Unsupported manifest version %d", from)
+    }
+
+    for _, mig := range migrations {
+        if mig.version >= from && mig.version < version {
+            mig.up(m)
+        }
+    }
+
+    for i := len(migrations) - 1; i >= 0; i-- {
+        mig := migrations[i]
+        if mig.version >= version && mig.version < from {
+            mig.down(m)
+        }
+    }
+
+    m["v"] = version
+    return nil
+}
+
+// DecodeManifest decodes a manifest of any supported version and upgrades
+// it to the current one. The version it had is returned along with it.
+func DecodeManifest(data []byte) (*Manifest, int, error) {
+    raw := make(rawManifest)
+    if err := decodeJSON(data, &raw); err != nil {
+        return nil, 0, err
+    }
+
+    version := rawVersion(raw)
+    if err := migrate(raw, ManifestVersion); err != nil {
+        return nil, version, err
+    }
+
+    data, err := json.Marshal(raw)
+    if err != nil {
+        return nil, version, err
+    }
+
+    m := &Manifest{}
+    if err := json.Unmarshal(data, m); err != nil {
+        return nil, version, err
+    }
+
+    return m, version, nil
+}
+
+// ManifestAs returns the manifest converted to the given version, as it
+// would be encoded by an image server speaking that version
+func ManifestAs(m *Manifest, version int) (interface{}, error) {
+    if version == ManifestVersion {
+        return m, nil
+    }
+
+    data, err := json.Marshal(m)
+    if err != nil {
+        return nil, err
+    }
+
+    raw := make(rawManifest)
+    if err := decodeJSON(data, &raw); err != nil {
+        return nil, err
+    }
+
+    if err := migrate(raw, version); err != nil {
+        return nil, err
+    }
+
+    return raw, nil
+}
@@ -0,0 +1,302 @@
+package image
+
+import (
+    "reflect"
+    "testing"
+    "encoding/json"
+)
+
+// v1 manifest of a dataset as served by dsapi
+const sampleV1 = `{
+    "uuid": "febaa412-6417-11e0-bc56-535d219f2590",
+    "name": "smartos",
+    "version": "1.3.12",
+    "urn": "sdc:sdc:smartos:1.3.12",
+    "description": "Base template to build other templates on",
+    "os": "smartos",
+    "type": "zone-dataset",
+    "platform_type": "smartos",
+    "creator_uuid": "352971aa-31ba-496c-9ade-a379feaecd52",
+    "vendor_uuid": "352971aa-31ba-496c-9ade-a379feaecd52",
+    "creator_name": "sdc",
+    "cloud_name": "sdc",
+    "created_at": "2011-04-11T08:45:00.000Z",
+    "updated_at": "2011-04-11T08:45:00.000Z",
+    "files": [
+        {
+            "path": "smartos-1.3.12.zfs.bz2",
+            "sha1": "246c1d0cdf40e4c7a4c1d7a5cd7c5ca2d8a3e09f",
+            "size": 47480510,
+            "url": "https://datasets.joyent.com/datasets/febaa412-6417-11e0-bc56-535d219f2590/smartos-1.3.12.zfs.bz2"
+        }
+    ],
+    "requirements": {
+        "networks": [{"name": "net0", "description": "public"}]
+    }
+}`
+
+// v2 manifest of a zone image as served by imgapi
+const sampleV2 = `{
+    "v": 2,
+    "uuid": "17c98640-1fdb-11e3-bf51-3708ce78e75a",
+    "owner": "930896af-bf8c-48d4-885c-6573a94b1853",
+    "name": "base64",
+    "version": "13.2.0",
+    "state": "active",
+    "disabled": false,
+    "public": true,
+    "published_at": "2013-09-17T19:17:51.374Z",
+    "type": "zone-dataset",
+    "os": "smartos",
+    "files": [
+        {
+            "sha1": "c15b5ad5fc3ec0d1bd8e5d73c1fd1a1d6aeb1fea",
+            "size": 92163017,
+            "compression": "gzip"
+        }
+    ],
+    "description": "A 64-bit SmartOS image with just essential packages installed. Ideal for users who are comfortable with setting up their own environment and tools.",
+    "homepage": "http://wiki.joyent.com/jpc2/SmartMachine+Base",
+    "urn": "sdc:sdc:base64:13.2.0",
+    "requirements": {
+        "min_platform": {"7.0": "20130729T063445Z"},
+        "networks": [{"name": "net0", "description": "public"}]
+    },
+    "tags": {"role": "os", "group": "base-64-lts"}
+}`
+
+// v2 manifest of a kvm image as served by imgapi
+const sampleV2Zvol = `{
+    "v": 2,
+    "uuid": "d2ba0f30-bbe8-11e2-a9a2-6bc116856d85",
+    "owner": "930896af-bf8c-48d4-885c-6573a94b1853",
+    "name": "centos-6",
+    "version": "2.4.2",
+    "state": "active",
+    "disabled": false,
+    "public": true,
+    "published_at": "2013-05-13T13:31:07Z",
+    "type": "zvol",
+    "os": "linux",
+    "files": [
+        {
+            "sha1": "5fa86d4a1a1e3e4c2c9f6d0b0b8d9de5b5f8a3c1",
+            "size": 406011796,
+            "compression": "gzip"
+        }
+    ],
+    "description": "CentOS 6.4 VM image",
+    "homepage": "https://docs.joyent.com/images/linux/centos",
+    "requirements": {
+        "networks": [{"name": "net0", "description": "public"}],
+        "ssh_key": true,
+        "min_platform": {"7.0": "20130506T233003Z"}
+    },
+    "nic_driver": "virtio",
+    "disk_driver": "virtio",
+    "cpu_type": "host",
+    "image_size": 10240,
+    "generate_passwords": true,
+    "users": [{"name": "root"}],
+    "billing_tags": ["centos"],
+    "traits": {"ssd": true, "max_iops": 9007199254740993}
+}`
+
+// decodeRaw decodes data into a generic map with numbers left as they are
+func decodeRaw(t *testing.T, data []byte) map[string]interface{} {
+    raw := make(map[string]interface{})
+    if err := decodeJSON(data, &raw); err != nil {
+        t.Fatalf("Failed to decode %s: %s", data, err)
+    }
+    return raw
+}
+
+// checkFields fails unless every field of expected has the same value in actual
+func checkFields(t *testing.T, expected, actual map[string]interface{}) {
+    for key, value := range expected {
+        if !reflect.DeepEqual(actual[key], value) {
+            t.Errorf("Field %s is %v, expected %v", key, actual[key], value)
+        }
+    }
+}
+
+func TestDecodeManifestV2RoundTrip(t *testing.T) {
+    for _, sample := range []string{sampleV2, sampleV2Zvol} {
+        m, version, err := DecodeManifest([]byte(sample))
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if version != 2 {
+            t.Errorf("Version is %d, expected 2", version)
+        }
+
+        data, err := json.Marshal(m)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        checkFields(t, decodeRaw(t, []byte(sample)), decodeRaw(t, data))
+
+        // Encoding the decoded manifest again gives the same result
+        again, _, err := DecodeManifest(data)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        dataAgain, err := json.Marshal(again)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if string(dataAgain) != string(data) {
+            t.Errorf("Second round trip changed the manifest:\n%s\n%s", data, dataAgain)
+        }
+    }
+}
+
+func TestDecodeManifestV1(t *testing.T) {
+    m, version, err := DecodeManifest([]byte(sampleV1))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if version != 1 {
+        t.Errorf("Version is %d, expected 1", version)
+    }
+
+    if m.V != 2 || m.Owner != "352971aa-31ba-496c-9ade-a379feaecd52" {
+        t.Errorf("Unexpected version %d or owner %s", m.V, m.Owner)
+    }
+
+    if m.PublishedAt != "2011-04-11T08:45:00.000Z" || m.CreatedAt != "" {
+        t.Errorf("Unexpected published_at %s or created_at %s", m.PublishedAt, m.CreatedAt)
+    }
+
+    if m.State != StateActive || !m.Public {
+        t.Errorf("Unexpected state %s or public %t", m.State, m.Public)
+    }
+
+    if m.Files[0].Size != 47480510 || m.Files[0].Compression != "bzip2" {
+        t.Errorf("Unexpected file size %d or compression %s", m.Files[0].Size, m.Files[0].Compression)
+    }
+}
+
+func TestDecodeManifestV1Public(t *testing.T) {
+    samples := map[string]bool{
+        `{"uuid": "febaa412-6417-11e0-bc56-535d219f2590"}`: true,
+        `{"uuid": "febaa412-6417-11e0-bc56-535d219f2590", "restricted_to_uuid": "352971aa-31ba-496c-9ade-a379feaecd52"}`: false,
+        `{"uuid": "febaa412-6417-11e0-bc56-535d219f2590", "public": false}`: false,
+        `{"uuid": "febaa412-6417-11e0-bc56-535d219f2590", "public": true, "restricted_to_uuid": "352971aa-31ba-496c-9ade-a379feaecd52"}`: true,
+    }
+
+    for sample, public := range samples {
+        m, _, err := DecodeManifest([]byte(sample))
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if m.Public != public {
+            t.Errorf("Public is %t for %s, expected %t", m.Public, sample, public)
+        }
+    }
+}
+
+func TestManifestAsV1RoundTrip(t *testing.T) {
+    m, _, err := DecodeManifest([]byte(sampleV1))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    v1, err := ManifestAs(m, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    data, err := json.Marshal(v1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Only the fields that were derived from others and the file
+    // locations on the old server don't come back
+    expected := decodeRaw(t, []byte(sampleV1))
+    delete(expected, "vendor_uuid")
+    delete(expected, "platform_type")
+    for _, f := range expected["files"].([]interface{}) {
+        file := f.(map[string]interface{})
+        delete(file, "path")
+        delete(file, "url")
+        file["compression"] = "bzip2"
+    }
+
+    actual := decodeRaw(t, data)
+    checkFields(t, expected, actual)
+
+    for _, key := range []string{"owner", "published_at", "public", "state"} {
+        if _, ok := actual[key]; ok {
+            t.Errorf("v1 manifest has v2 field %s", key)
+        }
+    }
+}
+
+func TestManifestAsV1DropsLocalFields(t *testing.T) {
+    m, _, err := DecodeManifest([]byte(sampleV2))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    m.Source = "https://images.example.com"
+    m.Cached = true
+    m.CreatedAt = "2020-01-02T03:04:05Z"
+    m.DeletedAt = "2020-02-03T04:05:06Z"
+
+    v1, err := ManifestAs(m, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    data, err := json.Marshal(v1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    raw := decodeRaw(t, data)
+    if raw["created_at"] != "2013-09-17T19:17:51.374Z" {
+        t.Errorf("created_at is %v, expected the publication time", raw["created_at"])
+    }
+
+    for _, key := range []string{"source", "cached", "deleted_at"} {
+        if _, ok := raw[key]; ok {
+            t.Errorf("v1 manifest has local field %s", key)
+        }
+    }
+}
+
+func TestDecodeManifestKeepsNumbers(t *testing.T) {
+    sample := `{"v": 2, "uuid": "17c98640-1fdb-11e3-bf51-3708ce78e75a", "ratio": 1.0, "count": 9007199254740993, "traits": {"max_iops": 9007199254740993}}`
+
+    m, _, err := DecodeManifest([]byte(sample))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for version := MinManifestVersion; version <= ManifestVersion; version++ {
+        versioned, err := ManifestAs(m, version)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        data, err := json.Marshal(versioned)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        raw := decodeRaw(t, data)
+        traits, _ := raw["traits"].(map[string]interface{})
+
+        if raw["ratio"] != json.Number("1.0") || raw["count"] != json.Number("9007199254740993") || traits["max_iops"] != json.Number("9007199254740993") {
+            t.Errorf("Numbers changed in v%d manifest %s", version, data)
+        }
+    }
+}
@@ -0,0 +1,109 @@
+package image
+
+import (
+    "fmt"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// stateRestored is the target of transitions which give the image back
+// the state it had before it failed or was deleted
+const stateRestored ManifestState = ""
+
+// Internal action finishing an upload, it is recorded as ActionUpload
+const actionUploaded Action = "uploaded"
+
+// transitions lists for every action the states it is allowed
+// in and the state the image is in afterwards
+var transitions = map[Action]map[ManifestState]ManifestState{
+    ActionUpload: {
+        StateUnactivated: StateCreating,
+    },
+    actionUploaded: {
+        StateCreating: StateUnactivated,
+    },
+    ActionActivate: {
+        StateUnactivated: StateActive,
+    },
+    ActionEnable: {
+        StateActive: StateActive,
+        StateDisabled: StateActive,
+    },
+    ActionDisable: {
+        StateUnactivated: StateDisabled,
+        StateActive: StateDisabled,
+        StateDisabled: StateDisabled,
+    },
+    // Files of unactivated images may still be replaced, which would
+    // leave variants of the replaced file behind
+    ActionRecompress: {
+        StateActive: StateActive,
+        StateDisabled: StateDisabled,
+    },
+    ActionFail: {
+        StateUnactivated: StateFailed,
+        StateActive: StateFailed,
+        StateDisabled: StateFailed,
+    },
+    ActionRecover: {
+        StateFailed: stateRestored,
+    },
+    ActionDelete: {
+        StateUnactivated: StateDeleted,
+        StateActive: StateDeleted,
+        StateDisabled: StateDeleted,
+        StateFailed: StateDeleted,
+    },
+    ActionRestore: {
+        StateDeleted: stateRestored,
+    },
+}
+
+// transition moves the manifest to the state following action, an error
+// is returned if the action is not allowed in the current state. The error
+// object is kept as long as the image is failed or deleted.
+func (self *Manifest) transition(action Action) errors.Error {
+    next, ok := transitions[action][self.State]
+    if !ok {
+        return transitionError(action, self.State)
+    }
+
+    if next == stateRestored {
+        next = restoredState(self)
+    }
+
+    self.State = next
+    if next != StateFailed && next != StateDeleted {
+        self.Error = nil
+    }
+
+    return nil
+}
+
+// transitionError returns the IMGAPI error for the illegal transitions
+// it has one for, the others conflict with the current state
+func transitionError(action Action, state ManifestState) errors.Error {
+    switch {
+    case action == ActionActivate && (state == StateActive || state == StateDisabled):
+        return errors.ImageAlreadyActivated(nil)
+    case action == ActionUpload && (state == StateActive || state == StateDisabled):
+        return errors.ImageFilesImmutable(nil)
+    }
+
+    err := fmt.Errorf("Can't %s an image in state %s", action, state)
+    return errors.InvalidStateTransition(err)
+}
+
+// restoredState returns the state a failed or deleted image had before,
+// deleted images which had an error were failed
+func restoredState(m *Manifest) ManifestState {
+    switch {
+    case m.State == StateDeleted && m.Error != nil:
+        return StateFailed
+    case m.PublishedAt == "":
+        return StateUnactivated
+    case m.Disabled:
+        return StateDisabled
+    default:
+        return StateActive
+    }
+}
@@ -0,0 +1,73 @@
+package image
+
+import (
+    "testing"
+    "net/http"
+)
+
+func TestTransitions(t *testing.T) {
+    published := "2015-08-20T12:51:44Z"
+    failure := &ManifestError{Code: "FileCorrupt", Message: "sha1 mismatch"}
+
+    tests := []struct {
+        action Action
+        before Manifest
+        state ManifestState
+        status int
+    }{
+        {ActionUpload, Manifest{State: StateUnactivated}, StateCreating, 0},
+        {ActionUpload, Manifest{State: StateActive}, StateActive, http.StatusUnprocessableEntity},
+        {actionUploaded, Manifest{State: StateCreating}, StateUnactivated, 0},
+        {ActionActivate, Manifest{State: StateUnactivated}, StateActive, 0},
+        {ActionActivate, Manifest{State: StateActive}, StateActive, http.StatusUnprocessableEntity},
+        {ActionActivate, Manifest{State: StateFailed}, StateFailed, http.StatusConflict},
+        {ActionEnable, Manifest{State: StateDisabled}, StateActive, 0},
+        {ActionEnable, Manifest{State: StateUnactivated}, StateUnactivated, http.StatusConflict},
+        {ActionDisable, Manifest{State: StateUnactivated}, StateDisabled, 0},
+        {ActionDisable, Manifest{State: StateActive}, StateDisabled, 0},
+        {ActionDisable, Manifest{State: StateDeleted}, StateDeleted, http.StatusConflict},
+        {ActionRecompress, Manifest{State: StateActive}, StateActive, 0},
+        {ActionRecompress, Manifest{State: StateUnactivated}, StateUnactivated, http.StatusConflict},
+        {ActionFail, Manifest{State: StateActive}, StateFailed, 0},
+        {ActionFail, Manifest{State: StateCreating}, StateCreating, http.StatusConflict},
+        {ActionRecover, Manifest{State: StateFailed, PublishedAt: published, Disabled: true, Error: failure}, StateDisabled, 0},
+        {ActionRecover, Manifest{State: StateFailed, Error: failure}, StateUnactivated, 0},
+        {ActionRecover, Manifest{State: StateActive}, StateActive, http.StatusConflict},
+        {ActionDelete, Manifest{State: StateFailed, Error: failure}, StateDeleted, 0},
+        {ActionDelete, Manifest{State: StateDeleted}, StateDeleted, http.StatusConflict},
+        {ActionRestore, Manifest{State: StateDeleted, PublishedAt: published}, StateActive, 0},
+        {ActionRestore, Manifest{State: StateDeleted, PublishedAt: published, Error: failure}, StateFailed, 0},
+        {ActionRestore, Manifest{State: StateActive}, StateActive, http.StatusConflict},
+    }
+
+    for _, test := range tests {
+        m := test.before
+        err := m.transition(test.action)
+
+        if test.status == 0 && err != nil {
+            t.Errorf("%s in state %s failed: %s", test.action, test.before.State, err)
+        } else if test.status != 0 && (err == nil || err.StatusCode() != test.status) {
+            t.Errorf("%s in state %s returned %v, expected status %d", test.action, test.before.State, err, test.status)
+        }
+
+        if m.State != test.state {
+            t.Errorf("%s in state %s moved to %s, expected %s", test.action, test.before.State, m.State, test.state)
+        }
+    }
+}
+
+func TestTransitionClearsError(t *testing.T) {
+    m := &Manifest{
+        State: StateFailed,
+        PublishedAt: "2015-08-20T12:51:44Z",
+        Error: &ManifestError{Code: "FileCorrupt", Message: "sha1 mismatch"},
+    }
+
+    if err := m.transition(ActionRecover); err != nil {
+        t.Fatal(err)
+    }
+
+    if m.State != StateActive || m.Error != nil {
+        t.Errorf("Recovered image is %s with error %v", m.State, m.Error)
+    }
+}
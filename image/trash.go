@@ -0,0 +1,103 @@
+package image
+
+import (
+    "time"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// Delete moves the image to the trash, it can be restored until
+// it is purged. Deleting an image in the trash does nothing.
+func (self *Pool) Delete(uuid, actor string) errors.Error {
+    // Find manifest with matching uuid
+    manifest, ok := self.findManifest(uuid)
+    if !ok {
+        return errors.ResourceNotFound(nil)
+    }
+
+    self.lock()
+    defer self.unlock()
+
+    if manifest.State == StateDeleted {
+        return nil
+    }
+
+    before := manifest.clone()
+    if err := manifest.transition(ActionDelete); err != nil {
+        return err
+    }
+    manifest.DeletedAt = time.Now().UTC().Format(time.RFC3339)
+
+    // Save manifests to disk
+    if err := self.saveManifests(self.manifests); err != nil {
+        manifest.State = before.State
+        manifest.DeletedAt = before.DeletedAt
+        return errors.InternalError(err)
+    }
+
+    self.notify(ActionDelete, actor, uuid, before, manifest)
+
+    return nil
+}
+
+// Restore takes the image out of the trash and gives it back
+// the state it had before it was deleted
+func (self *Pool) Restore(uuid, actor string) (*Manifest, errors.Error) {
+    // Find manifest with matching uuid
+    manifest, ok := self.findManifest(uuid)
+    if !ok {
+        return nil, errors.ResourceNotFound(nil)
+    }
+
+    self.lock()
+    defer self.unlock()
+
+    before := manifest.clone()
+    if err := manifest.transition(ActionRestore); err != nil {
+        return nil, err
+    }
+    manifest.DeletedAt = ""
+
+    // Save manifests to disk
+    if err := self.saveManifests(self.manifests); err != nil {
+        manifest.State = before.State
+        manifest.Error = before.Error
+        manifest.DeletedAt = before.DeletedAt
+        return nil, errors.InternalError(err)
+    }
+
+    self.notify(ActionRestore, actor, uuid, before, manifest)
+
+    return manifest, nil
+}
+
+// PurgeExpired purges the images that were deleted more than retention ago
+// and returns their uuids
+func (self *Pool) PurgeExpired(retention time.Duration, actor string) []string {
+    self.lock()
+    expired := make([]string, 0)
+    for _, m := range self.manifests {
+        if m.State != StateDeleted {
+            continue
+        }
+
+        deleted, err := time.Parse(time.RFC3339, m.DeletedAt)
+        if err != nil || time.Since(deleted) > retention {
+            expired = append(expired, m.Uuid)
+        }
+    }
+    self.unlock()
+
+    purged := make([]string, 0)
+    for _, uuid := range expired {
+        // The image may have been restored or purged in the meantime
+        err := self.purgeIf(uuid, actor, func(m *Manifest) bool {
+            return m.State == StateDeleted
+        })
+        if err == nil {
+            purged = append(purged, uuid)
+        }
+    }
+
+    return purged
+}
+
@@ -0,0 +1,67 @@
+package image
+
+import (
+    "io"
+    "fmt"
+    "sync"
+)
+
+var ErrUploadAborted = fmt.Errorf("Upload aborted by server shutdown")
+
+// uploads keeps track of in-flight uploads so they can be aborted
+// and cleaned up when the server shuts down
+type uploads struct {
+    aborted chan struct{}
+    isAborted bool
+    mutex *sync.Mutex
+    wg *sync.WaitGroup
+}
+
+func newUploads() *uploads {
+    return &uploads{
+        aborted: make(chan struct{}),
+        mutex: &sync.Mutex{},
+        wg: &sync.WaitGroup{},
+    }
+}
+
+// start registers a new upload and returns a reader which fails with
+// ErrUploadAborted once the uploads are aborted. The returned function
+// must be called when the upload is done.
+func (self *uploads) start(reader io.Reader) (io.Reader, func(), error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.isAborted {
+        return nil, nil, ErrUploadAborted
+    }
+
+    self.wg.Add(1)
+    return &abortableReader{reader, self.aborted}, self.wg.Done, nil
+}
+
+func (self *uploads) abort() {
+    self.mutex.Lock()
+    if !self.isAborted {
+        self.isAborted = true
+        close(self.aborted)
+    }
+    self.mutex.Unlock()
+
+    // Wait for the uploads to clean up after themselves
+    self.wg.Wait()
+}
+
+type abortableReader struct {
+    reader io.Reader
+    aborted chan struct{}
+}
+
+func (self *abortableReader) Read(p []byte) (int, error) {
+    select {
+    case <-self.aborted:
+        return 0, ErrUploadAborted
+    default:
+        return self.reader.Read(p)
+    }
+}
@@ -0,0 +1,73 @@
+package image
+
+import (
+    "fmt"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+var NicDrivers = map[string]bool{
+    "virtio": true,
+    "e1000": true,
+    "rtl8139": true,
+}
+
+var DiskDrivers = map[string]bool{
+    "virtio": true,
+    "ide": true,
+    "scsi": true,
+}
+
+var Brands = map[string]bool{
+    "joyent": true,
+    "joyent-minimal": true,
+    "lx": true,
+    "kvm": true,
+    "bhyve": true,
+}
+
+// validate checks the fields of a manifest created by a client, manifests
+// imported from other image servers are taken as they are
+func (self *Manifest) validate() errors.Error {
+    if self.Type == "zvol" && (self.NicDriver == "" || self.DiskDriver == "") {
+        err := fmt.Errorf("nic_driver and disk_driver are required for zvol images")
+        return errors.ValidationFailed(err)
+    }
+
+    if self.NicDriver != "" && !NicDrivers[self.NicDriver] {
+        err := fmt.Errorf("Invalid nic_driver %s", self.NicDriver)
+        return errors.ValidationFailed(err)
+    }
+
+    if self.DiskDriver != "" && !DiskDrivers[self.DiskDriver] {
+        err := fmt.Errorf("Invalid disk_driver %s", self.DiskDriver)
+        return errors.ValidationFailed(err)
+    }
+
+    if req := self.Requirements; req != nil {
+        if req.Brand != "" && !Brands[req.Brand] {
+            err := fmt.Errorf("Invalid requirements.brand %s", req.Brand)
+            return errors.ValidationFailed(err)
+        }
+
+        if req.MinRam < 0 || req.MaxRam < 0 || (req.MaxRam > 0 && req.MinRam > req.MaxRam) {
+            err := fmt.Errorf("Invalid requirements.min_ram %d and max_ram %d", req.MinRam, req.MaxRam)
+            return errors.ValidationFailed(err)
+        }
+
+        for i, network := range req.Networks {
+            if network == nil || network.Name == "" {
+                err := fmt.Errorf("requirements.networks[%d] must have a name", i)
+                return errors.ValidationFailed(err)
+            }
+        }
+    }
+
+    for i, user := range self.Users {
+        if user == nil || user.Name == "" {
+            err := fmt.Errorf("users[%d] must have a name", i)
+            return errors.ValidationFailed(err)
+        }
+    }
+
+    return nil
+}
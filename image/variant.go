@@ -0,0 +1,53 @@
+package image
+
+import (
+    "io"
+    "fmt"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// AddVariant writes reader as another compression of the image file with
+// the given sha1 and adds it after the other files of the image. The
+// variant is discarded if the image changed in the meantime or already has
+// a file with that compression.
+func (self *Pool) AddVariant(uuid, sha1sum, compression string, reader io.Reader, actor string) errors.Error {
+    manifest, ok := self.findManifest(uuid)
+    if !ok {
+        return errors.ResourceNotFound(nil)
+    }
+
+    _, err := self.writeFile(compression, reader, "", func(imageFile *ImageFile) errors.Error {
+        if !manifest.hasFile(sha1sum) {
+            err := fmt.Errorf("Image file %s was replaced", sha1sum)
+            return errors.ValidationFailed(err)
+        }
+
+        for _, file := range manifest.Files {
+            if file.Compression == compression {
+                err := fmt.Errorf("Image already has a %s file", compression)
+                return errors.ValidationFailed(err)
+            }
+        }
+
+        before := manifest.clone()
+        if err := manifest.transition(ActionRecompress); err != nil {
+            return err
+        }
+        manifest.Files = setFile(before.Files, len(before.Files), imageFile)
+
+        // Save manifests to disk
+        if err := self.saveManifests(self.manifests); err != nil {
+            manifest.Files = before.Files
+            return errors.InternalError(err)
+        }
+
+        self.notify(ActionRecompress, actor, uuid, before, manifest)
+
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
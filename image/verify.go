@@ -0,0 +1,159 @@
+package image
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "time"
+    "bytes"
+    "io/ioutil"
+    "crypto/md5"
+    "crypto/sha1"
+    "github.com/prasmussen/smartimages/errors"
+)
+
+// VerifyResult is the outcome of verifying the image file of an image,
+// Problem describes what is wrong if Ok is false
+type VerifyResult struct {
+    Uuid string `json:"uuid"`
+    Ok bool `json:"ok"`
+    Problem string `json:"problem,omitempty"`
+    Time time.Time `json:"time"`
+}
+
+// VerifyFile rehashes the image files of uuid and checks that they match
+// the sha1 in the manifest and that the md5 sidecars are present and correct.
+// Evicted files of images cached by the proxy are not a problem, they
+// are fetched again when needed. The catalog is not changed.
+func (self *Pool) VerifyFile(uuid string) (*VerifyResult, errors.Error) {
+    manifest, ok := self.findManifest(uuid)
+    if !ok {
+        return nil, errors.ResourceNotFound(nil)
+    }
+
+    self.lock()
+    files := make([]ImageFile, 0, len(manifest.Files))
+    for _, file := range manifest.Files {
+        files = append(files, *file)
+    }
+    cached := manifest.Cached
+    self.unlock()
+
+    result := &VerifyResult{Uuid: uuid, Ok: true, Time: time.Now()}
+
+    // Evicted files of cached images are fetched again when needed
+    for i := range files {
+        problem, err := self.checkFile(&files[i])
+        if os.IsNotExist(err) {
+            if cached {
+                continue
+            }
+            problem = "Image file is missing"
+        } else if err != nil {
+            problem = err.Error()
+        }
+
+        if problem != "" {
+            result.Ok = false
+            result.Problem = problem
+            if len(files) > 1 {
+                result.Problem = fmt.Sprintf("File %d: %s", i, problem)
+            }
+            break
+        }
+    }
+
+    return result, nil
+}
+
+// checkFile returns a description of the problem if the image file
+// doesn't match file, errors reading the files are returned as is
+func (self *Pool) checkFile(file *ImageFile) (string, error) {
+    f, err := os.Open(self.blobFpath(file.Sha1))
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+
+    shaHash := sha1.New()
+    md5Hash := md5.New()
+
+    nBytes, err := io.Copy(io.MultiWriter(shaHash, md5Hash), f)
+    if err != nil {
+        return "", err
+    }
+
+    if nBytes != file.Size {
+        return fmt.Sprintf("Size mismatch, expected %d got %d", file.Size, nBytes), nil
+    }
+
+    sha1sum := fmt.Sprintf("%x", shaHash.Sum(nil))
+    if sha1sum != file.Sha1 {
+        return fmt.Sprintf("Sha1 mismatch, expected %s got %s", file.Sha1, sha1sum), nil
+    }
+
+    md5sum, err := ioutil.ReadFile(self.blobMd5Fpath(file.Sha1))
+    if os.IsNotExist(err) {
+        return "Md5 sidecar is missing", nil
+    } else if err != nil {
+        return "", err
+    }
+
+    if !bytes.Equal(md5sum, md5Hash.Sum(nil)) {
+        return "Md5 sidecar does not match the image file", nil
+    }
+
+    return "", nil
+}
+
+// Verify verifies the image file of uuid like VerifyFile. Images with a
+// corrupt or missing file are moved to the failed state, failed images
+// whose file is fine again get the state they had before.
+func (self *Pool) Verify(uuid, actor string) (*VerifyResult, errors.Error) {
+    result, err := self.VerifyFile(uuid)
+    if err != nil {
+        return nil, err
+    }
+
+    manifest, ok := self.findManifest(uuid)
+    if !ok {
+        return nil, errors.ResourceNotFound(nil)
+    }
+
+    self.lock()
+    defer self.unlock()
+
+    // Only a change of the outcome changes the state
+    if result.Ok == (manifest.State != StateFailed) {
+        return result, nil
+    }
+
+    before := manifest.clone()
+    action := ActionFail
+    if result.Ok {
+        action = ActionRecover
+    }
+
+    // Images that are being uploaded are verified once they are done
+    if err := manifest.transition(action); err != nil {
+        return result, nil
+    }
+
+    if !result.Ok {
+        manifest.Error = &ManifestError{
+            Code: "ImageFileCorrupt",
+            Message: result.Problem,
+        }
+    }
+
+    // Save manifests to disk
+    if err := self.saveManifests(self.manifests); err != nil {
+        manifest.State = before.State
+        manifest.Error = before.Error
+        return nil, errors.InternalError(err)
+    }
+
+    self.notify(action, actor, uuid, before, manifest)
+
+    return result, nil
+}
@@ -0,0 +1,93 @@
+package log
+
+import (
+    "fmt"
+    "bytes"
+    "strings"
+    "reflect"
+    "strconv"
+    "encoding/json"
+)
+
+// Start and Success events of a request are logged at debug level, the
+// End event summarizing the request at info level and errors at error level
+type Level int
+
+const (
+    LevelDebug Level = iota
+    LevelInfo
+    LevelError
+)
+
+var levelNames = map[Level]string{
+    LevelDebug: "debug",
+    LevelInfo: "info",
+    LevelError: "error",
+}
+
+func ParseLevel(name string) (Level, error) {
+    for level, levelName := range levelNames {
+        if levelName == name {
+            return level, nil
+        }
+    }
+    return 0, fmt.Errorf("Unknown log level: %s", name)
+}
+
+func (self Level) String() string {
+    return levelNames[self]
+}
+
+type Format func(e Event) ([]byte, error)
+
+var allFormats = map[string]Format{
+    "json": formatJSON,
+    "logfmt": formatLogfmt,
+}
+
+func ParseFormat(name string) (Format, error) {
+    format, ok := allFormats[name]
+    if !ok {
+        return nil, fmt.Errorf("Unknown log format: %s", name)
+    }
+    return format, nil
+}
+
+func formatJSON(e Event) ([]byte, error) {
+    buf := &bytes.Buffer{}
+    err := json.NewEncoder(buf).Encode(e)
+    return buf.Bytes(), err
+}
+
+func formatLogfmt(e Event) ([]byte, error) {
+    buf := &bytes.Buffer{}
+
+    // Use the json field names in the order of the fields,
+    // empty fields are left out
+    value := reflect.ValueOf(e)
+    for i := 0; i < value.NumField(); i++ {
+        field := value.Field(i)
+        if field.IsZero() {
+            continue
+        }
+
+        key := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+
+        if buf.Len() > 0 {
+            buf.WriteByte(' ')
+        }
+        buf.WriteString(key)
+        buf.WriteByte('=')
+        buf.WriteString(logfmtValue(fmt.Sprint(field.Interface())))
+    }
+
+    buf.WriteByte('\n')
+    return buf.Bytes(), nil
+}
+
+func logfmtValue(value string) string {
+    if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+        return strconv.Quote(value)
+    }
+    return value
+}
@@ -2,16 +2,16 @@ package log
 
 import (
     "io"
-    "os"
     "fmt"
-    "encoding/json"
     "crypto/sha1"
     "time"
+    "sync"
     "net/http"
 )
 
 type Event struct {
     Timestamp int64 `json:"timestamp"`
+    Level string `json:"level"`
     Id string `json:"id"`
     Method string `json:"method"`
     Uri string `json:"uri"`
@@ -20,85 +20,203 @@ type Event struct {
     UserAgent string `json:"userAgent"`
     Message string `json:"message"`
     Error string `json:"error"`
+    ImageUuid string `json:"imageUuid,omitempty"`
+    Compression string `json:"compression,omitempty"`
+    Status int `json:"status,omitempty"`
+    Bytes int64 `json:"bytes,omitempty"`
+    Duration float64 `json:"duration,omitempty"`
 }
 
+const (
+    RequestIdHeader = "X-Request-Id"
+    maxRequestIdLength = 128
+)
+
 type Logger struct {
-    file *os.File
+    sink Sink
+    level Level
+    format Format
+    mutex *sync.Mutex
 }
 
-func New(fname string) (*Logger, error) {
-    var f *os.File
+func New(opts Options) (*Logger, error) {
+    logger := &Logger{mutex: &sync.Mutex{}}
+    if err := logger.Reopen(opts); err != nil {
+        return nil, err
+    }
+    return logger, nil
+}
 
-    // Log to stdout if no filename was provided
-    if fname == "" {
-        f = os.Stdout
-    } else {
-        var err error
-        f, err = os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
-        if err != nil {
-            return nil, err
-        }
+// Reopen replaces the current sink with a new one created from opts,
+// which is needed after the log file has been rotated externally.
+// The current sink is kept if the new one can't be created.
+func (self *Logger) Reopen(opts Options) error {
+    if err := opts.Validate(); err != nil {
+        return err
     }
 
-    return &Logger{f}, nil
+    level, _ := ParseLevel(opts.Level)
+    format, _ := ParseFormat(opts.Format)
+
+    sink, err := NewSink(opts)
+    if err != nil {
+        return err
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.sink != nil {
+        self.sink.Close()
+    }
+
+    self.sink = sink
+    self.level = level
+    self.format = format
+    return nil
 }
 
-func (self *Logger) JSON(v interface{}) {
-    json.NewEncoder(self.file).Encode(v)
+func (self *Logger) Log(level Level, e Event) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if level < self.level {
+        return
+    }
+
+    e.Level = level.String()
+
+    line, err := self.format(e)
+    if err != nil {
+        return
+    }
+
+    self.sink.Write(level, line)
 }
 
 func (self *Logger) Close() {
-    self.file.Close()
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.sink.Close()
+}
+
+// Infof logs a message of a background task. A nil logger prints the
+// message instead, for the commands which run without one.
+func (self *Logger) Infof(format string, args ...interface{}) {
+    self.logf(LevelInfo, format, args...)
+}
+
+// Errorf logs a failure of a background task like Infof
+func (self *Logger) Errorf(format string, args ...interface{}) {
+    self.logf(LevelError, format, args...)
+}
+
+func (self *Logger) logf(level Level, format string, args ...interface{}) {
+    msg := fmt.Sprintf(format, args...)
+    if self == nil {
+        fmt.Println(msg)
+        return
+    }
+
+    self.Log(level, Event{Timestamp: time.Now().Unix(), Message: msg})
 }
 
 func (self *Logger) RequestStart(req *http.Request) *RequestLogger {
-    // Generate a uniq request id
-    h := sha1.New()
-    uniqId := fmt.Sprintf("%d %s", time.Now().UnixNano(), req.RemoteAddr)
-    io.WriteString(h, uniqId)
+    query := req.URL.Query()
 
-    // Add static fields
+    // Add static fields, the uuid query parameter is set by the router
     event := Event{
-        Id: fmt.Sprintf("%x", h.Sum(nil)),
+        Id: requestId(req),
         Method: req.Method,
         Uri: req.URL.RequestURI(),
         Host: req.Host,
         RemoteAddr: req.RemoteAddr,
         UserAgent: req.Header.Get("user-agent"),
+        ImageUuid: query.Get(":uuid"),
+        Compression: query.Get("compression"),
     }
 
-    logger := &RequestLogger{self, func() Event {
-        event.Timestamp = time.Now().Unix()
-        return event
-    }}
-    
+    logger := &RequestLogger{self, event, time.Now()}
+
     // Log start of request
-    logger.Message("Start")
+    logger.Log(LevelDebug, logger.message("Start"))
 
     return logger
 }
 
+// requestId returns the request id given by the client,
+// or generates a uniq one if it's missing or invalid
+func requestId(req *http.Request) string {
+    id := req.Header.Get(RequestIdHeader)
+    if isValidRequestId(id) {
+        return id
+    }
+
+    h := sha1.New()
+    uniqId := fmt.Sprintf("%d %s", time.Now().UnixNano(), req.RemoteAddr)
+    io.WriteString(h, uniqId)
+    return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func isValidRequestId(id string) bool {
+    if id == "" || len(id) > maxRequestIdLength {
+        return false
+    }
+
+    // Only allow printable ascii characters
+    for _, c := range id {
+        if c < 0x21 || c > 0x7e {
+            return false
+        }
+    }
+
+    return true
+}
+
 type RequestLogger struct {
     *Logger
-    event func() Event
+    static Event
+    start time.Time
+}
+
+func (self *RequestLogger) Id() string {
+    return self.static.Id
+}
+
+func (self *RequestLogger) event() Event {
+    e := self.static
+    e.Timestamp = time.Now().Unix()
+    return e
 }
 
 func (self *RequestLogger) Success() {
-    self.Message("Success")
+    self.Log(LevelDebug, self.message("Success"))
 }
 
-func (self *RequestLogger) RequestEnd() {
-    self.Message("End")
+// RequestEnd logs the response status code, the number of
+// response bytes and the duration of the request in seconds
+func (self *RequestLogger) RequestEnd(status int, bytes int64) {
+    e := self.event()
+    e.Message = "End"
+    e.Status = status
+    e.Bytes = bytes
+    e.Duration = time.Since(self.start).Seconds()
+    self.Log(LevelInfo, e)
 }
 
 func (self *RequestLogger) Message(msg string) {
+    self.Log(LevelInfo, self.message(msg))
+}
+
+func (self *RequestLogger) message(msg string) Event {
     e := self.event()
     e.Message = msg
-    self.JSON(e)
+    return e
 }
 
 func (self *RequestLogger) Error(err error) {
     e := self.event()
     e.Error = err.Error()
-    self.JSON(e)
+    self.Log(LevelError, e)
 }
@@ -0,0 +1,181 @@
+package log
+
+import (
+    "os"
+    "fmt"
+)
+
+// Sink is the destination of formatted log lines
+type Sink interface {
+    Write(level Level, line []byte) error
+    Close() error
+}
+
+// Options describes which sink to log to and how to format the log lines
+type Options struct {
+    // Sink is one of file, rotate, stderr or syslog
+    Sink string
+    // File is the log file used by the file and rotate sinks,
+    // the file sink logs to stdout if it is empty
+    File string
+    Level string
+    Format string
+    // MaxSize is the size in bytes at which the rotate sink rotates the file
+    MaxSize int64
+    // MaxFiles is the number of rotated files kept by the rotate sink
+    MaxFiles int
+    // SyslogAddr is the address of the syslog server as network://host:port,
+    // the local syslog daemon is used if it is empty
+    SyslogAddr string
+}
+
+func (self Options) Validate() error {
+    if _, err := ParseLevel(self.Level); err != nil {
+        return err
+    }
+
+    if _, err := ParseFormat(self.Format); err != nil {
+        return err
+    }
+
+    switch self.Sink {
+    case "file", "stderr", "syslog":
+    case "rotate":
+        if self.File == "" {
+            return fmt.Errorf("The rotate sink requires a log file")
+        }
+        if self.MaxSize <= 0 || self.MaxFiles <= 0 {
+            return fmt.Errorf("The rotate sink requires a positive max size and max files")
+        }
+    default:
+        return fmt.Errorf("Unknown log sink: %s", self.Sink)
+    }
+
+    return nil
+}
+
+func NewSink(opts Options) (Sink, error) {
+    switch opts.Sink {
+    case "file":
+        return newFileSink(opts.File)
+    case "stderr":
+        return &fileSink{file: os.Stderr}, nil
+    case "rotate":
+        return newRotatingSink(opts.File, opts.MaxSize, opts.MaxFiles)
+    case "syslog":
+        return newSyslogSink(opts.SyslogAddr)
+    }
+
+    return nil, fmt.Errorf("Unknown log sink: %s", opts.Sink)
+}
+
+// fileSink writes to a file, or stdout if no filename was provided
+type fileSink struct {
+    fname string
+    file *os.File
+}
+
+func newFileSink(fname string) (*fileSink, error) {
+    f, err := openFile(fname)
+    if err != nil {
+        return nil, err
+    }
+
+    return &fileSink{fname, f}, nil
+}
+
+func openFile(fname string) (*os.File, error) {
+    // Log to stdout if no filename was provided
+    if fname == "" {
+        return os.Stdout, nil
+    }
+    return os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+}
+
+func (self *fileSink) Write(level Level, line []byte) error {
+    _, err := self.file.Write(line)
+    return err
+}
+
+func (self *fileSink) Close() error {
+    self.file.Sync()
+
+    // Leave stdout / stderr open
+    if isStdFile(self.file) {
+        return nil
+    }
+    return self.file.Close()
+}
+
+func isStdFile(f *os.File) bool {
+    return f == os.Stdout || f == os.Stderr
+}
+
+// rotatingSink writes to a file which is rotated when it exceeds maxSize.
+// Rotated files are named <fname>.1 to <fname>.<maxFiles>, where 1 is the newest.
+type rotatingSink struct {
+    *fileSink
+    maxSize int64
+    maxFiles int
+    size int64
+}
+
+func newRotatingSink(fname string, maxSize int64, maxFiles int) (*rotatingSink, error) {
+    sink := &rotatingSink{
+        maxSize: maxSize,
+        maxFiles: maxFiles,
+    }
+
+    if err := sink.open(fname); err != nil {
+        return nil, err
+    }
+
+    return sink, nil
+}
+
+func (self *rotatingSink) open(fname string) error {
+    fsink, err := newFileSink(fname)
+    if err != nil {
+        return err
+    }
+
+    // Continue from the current size of the file
+    info, err := fsink.file.Stat()
+    if err != nil {
+        fsink.Close()
+        return err
+    }
+
+    self.fileSink = fsink
+    self.size = info.Size()
+    return nil
+}
+
+func (self *rotatingSink) Write(level Level, line []byte) error {
+    if self.size > 0 && self.size + int64(len(line)) > self.maxSize {
+        if err := self.rotate(); err != nil {
+            return err
+        }
+    }
+
+    n, err := self.file.Write(line)
+    self.size += int64(n)
+    return err
+}
+
+func (self *rotatingSink) rotate() error {
+    fname := self.fname
+    self.Close()
+
+    // Shift the rotated files, the oldest one is overwritten
+    for i := self.maxFiles - 1; i > 0; i-- {
+        os.Rename(fmt.Sprintf("%s.%d", fname, i), fmt.Sprintf("%s.%d", fname, i + 1))
+    }
+
+    // Keep logging to the current file if it can't be renamed
+    err := os.Rename(fname, fname + ".1")
+    if openErr := self.open(fname); openErr != nil {
+        return openErr
+    }
+    return err
+}
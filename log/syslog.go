@@ -0,0 +1,49 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package log
+
+import (
+    "strings"
+    "log/syslog"
+)
+
+type syslogSink struct {
+    writer *syslog.Writer
+}
+
+func newSyslogSink(addr string) (*syslogSink, error) {
+    writer, err := dialSyslog(addr)
+    if err != nil {
+        return nil, err
+    }
+
+    return &syslogSink{writer}, nil
+}
+
+func dialSyslog(addr string) (*syslog.Writer, error) {
+    // Use the local syslog daemon if no address was provided
+    network := ""
+    if i := strings.Index(addr, "://"); i != -1 {
+        network = addr[:i]
+        addr = addr[i + 3:]
+    }
+
+    return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "smartimages")
+}
+
+func (self *syslogSink) Write(level Level, line []byte) error {
+    msg := strings.TrimSuffix(string(line), "\n")
+
+    switch level {
+    case LevelDebug:
+        return self.writer.Debug(msg)
+    case LevelError:
+        return self.writer.Err(msg)
+    }
+    return self.writer.Info(msg)
+}
+
+func (self *syslogSink) Close() error {
+    return self.writer.Close()
+}
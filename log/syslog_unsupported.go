@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package log
+
+import (
+    "fmt"
+    "runtime"
+)
+
+func newSyslogSink(addr string) (Sink, error) {
+    return nil, fmt.Errorf("The syslog sink is not supported on %s", runtime.GOOS)
+}
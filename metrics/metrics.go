@@ -0,0 +1,55 @@
+package metrics
+
+import (
+    "io"
+    "time"
+)
+
+// Default latency buckets in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type Metrics struct {
+    Requests *Counter
+    RequestDuration *Histogram
+    BytesUploaded *Counter
+    BytesDownloaded *Counter
+    ActiveTransfers *Gauge
+    Images *Gauge
+    ManifestSaveDuration *Histogram
+}
+
+func New() *Metrics {
+    return &Metrics{
+        Requests: NewCounter("smartimages_http_requests_total", "Number of http requests.", "route", "status"),
+        RequestDuration: NewHistogram("smartimages_http_request_duration_seconds", "Duration of http requests.", DefaultBuckets, "route", "status"),
+        BytesUploaded: NewCounter("smartimages_uploaded_bytes_total", "Number of image file bytes uploaded."),
+        BytesDownloaded: NewCounter("smartimages_downloaded_bytes_total", "Number of image file bytes downloaded."),
+        ActiveTransfers: NewGauge("smartimages_active_transfers", "Number of image file transfers in progress.", "direction"),
+        Images: NewGauge("smartimages_images", "Number of images in the catalog.", "state"),
+        ManifestSaveDuration: NewHistogram("smartimages_manifest_save_duration_seconds", "Duration of saving the manifests to disk.", DefaultBuckets),
+    }
+}
+
+func (self *Metrics) families() []*family {
+    return []*family{
+        self.Requests.family,
+        self.RequestDuration.family,
+        self.BytesUploaded.family,
+        self.BytesDownloaded.family,
+        self.ActiveTransfers.family,
+        self.Images.family,
+        self.ManifestSaveDuration.family,
+    }
+}
+
+// Write writes all metrics in the prometheus text exposition format
+func (self *Metrics) Write(w io.Writer) {
+    for _, f := range self.families() {
+        f.writeTo(w)
+    }
+}
+
+// Since returns the number of seconds elapsed since t
+func Since(t time.Time) float64 {
+    return time.Since(t).Seconds()
+}
@@ -0,0 +1,203 @@
+package metrics
+
+import (
+    "io"
+    "fmt"
+    "sort"
+    "sync"
+    "strings"
+    "strconv"
+)
+
+// family holds all series of a metric, one for each unique set of label values
+type family struct {
+    name string
+    help string
+    typ string
+    labels []string
+    buckets []float64
+    series map[string]*series
+    mutex *sync.Mutex
+}
+
+type series struct {
+    labelValues []string
+    value float64
+    counts []uint64
+    sum float64
+    count uint64
+}
+
+func newFamily(name, help, typ string, labels []string) *family {
+    return &family{
+        name: name,
+        help: help,
+        typ: typ,
+        labels: labels,
+        series: make(map[string]*series),
+        mutex: &sync.Mutex{},
+    }
+}
+
+// get returns the series for the given label values, the caller must hold the lock
+func (self *family) get(labelValues []string) *series {
+    if len(labelValues) != len(self.labels) {
+        panic(fmt.Sprintf("%s: expected %d label values, got %d", self.name, len(self.labels), len(labelValues)))
+    }
+
+    key := strings.Join(labelValues, "\xff")
+    s, ok := self.series[key]
+    if !ok {
+        s = &series{
+            labelValues: labelValues,
+            counts: make([]uint64, len(self.buckets)),
+        }
+        self.series[key] = s
+    }
+    return s
+}
+
+func (self *family) writeTo(w io.Writer) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    fmt.Fprintf(w, "# HELP %s %s\n", self.name, self.help)
+    fmt.Fprintf(w, "# TYPE %s %s\n", self.name, self.typ)
+
+    // Sort series to get a stable output
+    keys := make([]string, 0, len(self.series))
+    for key := range self.series {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        s := self.series[key]
+
+        if self.typ != "histogram" {
+            fmt.Fprintf(w, "%s%s %s\n", self.name, self.formatLabels(s.labelValues, ""), formatFloat(s.value))
+            continue
+        }
+
+        // Bucket counts are cumulative
+        var cumulative uint64
+        for i, bound := range self.buckets {
+            cumulative += s.counts[i]
+            fmt.Fprintf(w, "%s_bucket%s %d\n", self.name, self.formatLabels(s.labelValues, formatFloat(bound)), cumulative)
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", self.name, self.formatLabels(s.labelValues, "+Inf"), s.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", self.name, self.formatLabels(s.labelValues, ""), formatFloat(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", self.name, self.formatLabels(s.labelValues, ""), s.count)
+    }
+}
+
+func (self *family) formatLabels(labelValues []string, le string) string {
+    pairs := make([]string, 0, len(labelValues) + 1)
+    for i, value := range labelValues {
+        pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", self.labels[i], escapeLabel(value)))
+    }
+
+    if le != "" {
+        pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+    }
+
+    if len(pairs) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+    return labelEscaper.Replace(value)
+}
+
+func formatFloat(f float64) string {
+    return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type Counter struct {
+    *family
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+    return &Counter{newFamily(name, help, "counter", labels)}
+}
+
+func (self *Counter) Inc(labelValues ...string) {
+    self.Add(1, labelValues...)
+}
+
+func (self *Counter) Add(v float64, labelValues ...string) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.get(labelValues).value += v
+}
+
+type Gauge struct {
+    *family
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+    return &Gauge{newFamily(name, help, "gauge", labels)}
+}
+
+func (self *Gauge) Set(v float64, labelValues ...string) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.get(labelValues).value = v
+}
+
+func (self *Gauge) Add(v float64, labelValues ...string) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.get(labelValues).value += v
+}
+
+func (self *Gauge) Inc(labelValues ...string) {
+    self.Add(1, labelValues...)
+}
+
+func (self *Gauge) Dec(labelValues ...string) {
+    self.Add(-1, labelValues...)
+}
+
+// Reset removes all series, useful for gauges that are recalculated on every scrape
+func (self *Gauge) Reset() {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.series = make(map[string]*series)
+}
+
+type Histogram struct {
+    *family
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+    f := newFamily(name, help, "histogram", labels)
+    f.buckets = buckets
+    return &Histogram{f}
+}
+
+func (self *Histogram) Observe(v float64, labelValues ...string) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    s := self.get(labelValues)
+    s.sum += v
+    s.count++
+
+    // Only the first matching bucket is incremented,
+    // the cumulative counts are calculated on output
+    for i, bound := range self.buckets {
+        if v <= bound {
+            s.counts[i]++
+            break
+        }
+    }
+}
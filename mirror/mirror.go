@@ -0,0 +1,297 @@
+package mirror
+
+import (
+    "fmt"
+    "context"
+    "sync"
+    "time"
+    "strings"
+    "net/url"
+    "net/http"
+    "encoding/json"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/responder"
+    "github.com/prasmussen/smartimages/log"
+)
+
+const (
+    DefaultInterval = 3600
+)
+
+// Upstream is an image server to mirror. Only active public images matching
+// all filters are imported, the filters are the same as for listing images.
+type Upstream struct {
+    Url string
+    // Interval is the number of seconds between syncs
+    Interval int
+    Filters map[string]string
+}
+
+func (self *Upstream) interval() time.Duration {
+    if self.Interval <= 0 {
+        return DefaultInterval * time.Second
+    }
+    return time.Duration(self.Interval) * time.Second
+}
+
+// Validate makes sure the upstream url and filters are valid
+func (self *Upstream) Validate() error {
+    u, err := url.Parse(self.Url)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+        return fmt.Errorf("Invalid url: %s", self.Url)
+    }
+
+    for name, value := range self.Filters {
+        if _, ok := image.GetFilter(name, value); !ok {
+            return fmt.Errorf("Unknown filter: %s", name)
+        }
+    }
+
+    return nil
+}
+
+// Mirror periodically imports new images from the upstream servers into the pool
+type Mirror struct {
+    pool *image.Pool
+    upstreams []Upstream
+    lastSync map[string]time.Time
+    client *http.Client
+    wake chan struct{}
+    ctx context.Context
+    cancel func()
+    done chan struct{}
+    logger *log.Logger
+    mutex *sync.Mutex
+}
+
+func New(pool *image.Pool, upstreams []Upstream, logger *log.Logger) *Mirror {
+    // Cancelling the context aborts running downloads on close
+    ctx, cancel := context.WithCancel(context.Background())
+
+    mirror := &Mirror{
+        pool: pool,
+        upstreams: upstreams,
+        lastSync: make(map[string]time.Time),
+        client: &http.Client{},
+        wake: make(chan struct{}, 1),
+        ctx: ctx,
+        cancel: cancel,
+        done: make(chan struct{}),
+        logger: logger,
+        mutex: &sync.Mutex{},
+    }
+
+    go mirror.run()
+
+    return mirror
+}
+
+// SetUpstreams replaces the upstreams, new upstreams are synced right away
+func (self *Mirror) SetUpstreams(upstreams []Upstream) {
+    self.mutex.Lock()
+    self.upstreams = upstreams
+    self.mutex.Unlock()
+
+    select {
+    case self.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Close stops syncing and waits for a running sync to be aborted
+func (self *Mirror) Close() {
+    self.cancel()
+    <-self.done
+}
+
+func (self *Mirror) run() {
+    defer close(self.done)
+
+    for {
+        for _, upstream := range self.due() {
+            if err := self.Sync(upstream); err != nil {
+                self.logger.Errorf("Failed to mirror %s: %s", upstream.Url, err)
+            }
+        }
+
+        select {
+        case <-self.wake:
+        case <-time.After(time.Minute):
+        case <-self.ctx.Done():
+            return
+        }
+    }
+}
+
+// due returns the upstreams which have not been synced within their interval
+func (self *Mirror) due() []Upstream {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    now := time.Now()
+    upstreams := make([]Upstream, 0)
+
+    for _, upstream := range self.upstreams {
+        if now.Sub(self.lastSync[upstream.Url]) >= upstream.interval() {
+            upstreams = append(upstreams, upstream)
+            self.lastSync[upstream.Url] = now
+        }
+    }
+
+    return upstreams
+}
+
+// Sync imports all matching images from upstream that are not in the pool
+// yet and fetches the files that are missing from images it imported before
+func (self *Mirror) Sync(upstream Upstream) error {
+    filters := []image.Filter{
+        image.StateFilter(string(image.StateActive)),
+        image.PublicFilter("true"),
+    }
+    for name, value := range upstream.Filters {
+        filter, ok := image.GetFilter(name, value)
+        if !ok {
+            return fmt.Errorf("Unknown filter: %s", name)
+        }
+        filters = append(filters, filter)
+    }
+
+    manifests, err := self.list(upstream)
+    if err != nil {
+        return err
+    }
+
+    for _, m := range manifests {
+        if self.ctx.Err() != nil {
+            return nil
+        }
+
+        if !image.MatchManifest(filters, m) {
+            continue
+        }
+
+        if local, err := self.pool.Get(m.Uuid); err == nil {
+            self.restoreFiles(upstream, local)
+            continue
+        }
+
+        if err := self.importImage(upstream, m); err != nil {
+            self.logger.Errorf("Failed to import %s (%s %s) from %s: %s", m.Uuid, m.Name, m.Version, upstream.Url, err)
+            continue
+        }
+
+        self.logger.Infof("Imported %s (%s %s) from %s", m.Uuid, m.Name, m.Version, upstream.Url)
+    }
+
+    return nil
+}
+
+func (self *Mirror) list(upstream Upstream) ([]*image.Manifest, error) {
+    // Let the upstream do the filtering as well to reduce the listing size
+    query := url.Values{}
+    query.Set("state", string(image.StateActive))
+    query.Set("public", "true")
+    for name, value := range upstream.Filters {
+        query.Set(name, value)
+    }
+
+    res, err := self.get(imagesUrl(upstream.Url) + "?" + query.Encode())
+    if err != nil {
+        return nil, err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("Unexpected status listing images: %s", res.Status)
+    }
+
+    manifests := make([]*image.Manifest, 0)
+    if err := json.NewDecoder(res.Body).Decode(&manifests); err != nil {
+        return nil, err
+    }
+
+    return manifests, nil
+}
+
+func (self *Mirror) importImage(upstream Upstream, m *image.Manifest) error {
+    if len(m.Files) == 0 {
+        return fmt.Errorf("Manifest has no files")
+    }
+
+    // Record where the image came from
+    m.Source = upstream.Url
+
+    // The first file imports the image, the others are added to it
+    for i := range m.Files {
+        if err := self.importFile(upstream, m, i, i > 0); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// restoreFiles fetches the files of an image imported from upstream that
+// are not in the pool, like the ones that failed to download before
+func (self *Mirror) restoreFiles(upstream Upstream, m *image.Manifest) {
+    // Images in the trash are left alone
+    if m.Source != upstream.Url || m.State == image.StateDeleted {
+        return
+    }
+
+    missing := self.pool.MissingFiles(m)
+    if len(missing) == 0 {
+        return
+    }
+
+    for _, index := range missing {
+        if err := self.importFile(upstream, m, index, true); err != nil {
+            self.logger.Errorf("Failed to fetch file %d of %s (%s %s) from %s: %s", index, m.Uuid, m.Name, m.Version, upstream.Url, err)
+            return
+        }
+    }
+
+    self.logger.Infof("Fetched the missing files of %s (%s %s) from %s", m.Uuid, m.Name, m.Version, upstream.Url)
+}
+
+// importFile imports the image with the file at index,
+// or adds the file to the image if restore is set
+func (self *Mirror) importFile(upstream Upstream, m *image.Manifest, index int, restore bool) error {
+    res, err := self.get(fmt.Sprintf("%s/%s/file?index=%d", imagesUrl(upstream.Url), m.Uuid, index))
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode != http.StatusOK {
+        return fmt.Errorf("Unexpected status downloading file: %s", res.Status)
+    }
+
+    // Servers that don't know about ?index serve the first file for any
+    // index, the first file is trusted if the server doesn't say
+    sha1sum := res.Header.Get(responder.ImageSha1Header)
+    if (sha1sum == "" && index > 0) || (sha1sum != "" && sha1sum != m.Files[index].Sha1) {
+        return fmt.Errorf("Upstream doesn't serve file %d", index)
+    }
+
+    if !restore {
+        err = self.pool.Import(m, index, res.Body, "mirror:" + upstream.Url)
+    } else {
+        err = self.pool.RestoreFile(m.Uuid, index, res.Body)
+    }
+
+    return err
+}
+
+func (self *Mirror) get(rawUrl string) (*http.Response, error) {
+    req, err := http.NewRequest("GET", rawUrl, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    return self.client.Do(req.WithContext(self.ctx))
+}
+
+func imagesUrl(baseUrl string) string {
+    return strings.TrimSuffix(baseUrl, "/") + "/images"
+}
@@ -0,0 +1,50 @@
+package mirror
+
+import (
+    "testing"
+    "net/http"
+    "net/http/httptest"
+)
+
+func TestUpstreamValidate(t *testing.T) {
+    tests := []struct {
+        upstream Upstream
+        valid bool
+    }{
+        {Upstream{Url: "https://images.example.com"}, true},
+        {Upstream{Url: "https://images.example.com", Filters: map[string]string{"os": "smartos"}}, true},
+        {Upstream{Url: "https://images.example.com", Filters: map[string]string{"colour": "blue"}}, false},
+        {Upstream{Url: "ftp://images.example.com"}, false},
+    }
+
+    for _, test := range tests {
+        err := test.upstream.Validate()
+        if (err == nil) != test.valid {
+            t.Errorf("Validate of %s %v returned %v", test.upstream.Url, test.upstream.Filters, err)
+        }
+    }
+}
+
+func TestSyncUnknownFilter(t *testing.T) {
+    requests := 0
+    server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+        requests++
+        res.Write([]byte("[]"))
+    }))
+    defer server.Close()
+
+    mirror := New(nil, nil, nil)
+    defer mirror.Close()
+
+    if err := mirror.Sync(Upstream{Url: server.URL, Filters: map[string]string{"os": "smartos"}}); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := mirror.Sync(Upstream{Url: server.URL, Filters: map[string]string{"colour": "blue"}}); err == nil {
+        t.Errorf("Sync with an unknown filter succeeded")
+    }
+
+    if requests != 1 {
+        t.Errorf("Upstream got %d requests, expected 1", requests)
+    }
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+    "io"
+    "fmt"
+    "sort"
+    "sync"
+    "strings"
+    "net/http"
+    "encoding/json"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/errors"
+    "github.com/prasmussen/smartimages/responder"
+    "github.com/prasmussen/smartimages/log"
+)
+
+// Proxy serves images that are not in the pool from an upstream image server.
+// Image files are added to the pool while they are streamed to the client,
+// and the least recently used ones are evicted when the cache grows too big.
+type Proxy struct {
+    pool *image.Pool
+    upstream string
+    maxSize int64
+    client *http.Client
+    logger *log.Logger
+    evictMutex *sync.Mutex
+}
+
+// New returns a proxy for upstream, the image files fetched from an upstream
+// are evicted when their total size exceeds maxSize, zero means no limit
+func New(pool *image.Pool, upstream string, maxSize int64, logger *log.Logger) *Proxy {
+    return &Proxy{
+        pool: pool,
+        upstream: strings.TrimSuffix(upstream, "/"),
+        maxSize: maxSize,
+        logger: logger,
+        client: &http.Client{},
+        evictMutex: &sync.Mutex{},
+    }
+}
+
+// GetManifest fetches the manifest of uuid from the upstream
+func (self *Proxy) GetManifest(uuid string) (*image.Manifest, errors.Error) {
+    res, err := self.client.Get(fmt.Sprintf("%s/images/%s", self.upstream, uuid))
+    if err != nil {
+        return nil, errors.ServiceUnavailableError(err)
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode == http.StatusNotFound {
+        return nil, errors.ResourceNotFound(nil)
+    } else if res.StatusCode != http.StatusOK {
+        err := fmt.Errorf("Unexpected status from upstream: %s", res.Status)
+        return nil, errors.ServiceUnavailableError(err)
+    }
+
+    manifest := &image.Manifest{}
+    if err := json.NewDecoder(res.Body).Decode(manifest); err != nil {
+        return nil, errors.ServiceUnavailableError(err)
+    }
+
+    return manifest, nil
+}
+
+// ServeFile streams the image file of uuid picked by sel from its source to
+// res and adds it to the pool. Images that are in the pool are fetched from the server
+// they came from, images without a source are never fetched. The number of
+// bytes written to res is returned, an error is only returned if nothing
+// was written yet.
+func (self *Proxy) ServeFile(res http.ResponseWriter, uuid string, sel image.FileSelector) (int64, errors.Error) {
+    local, err := self.pool.Get(uuid)
+    if err != nil && err.StatusCode() != http.StatusNotFound {
+        return 0, err
+    }
+
+    manifest := local
+    if local == nil {
+        if manifest, err = self.GetManifest(uuid); err != nil {
+            return 0, err
+        }
+        manifest.Source = self.upstream
+        manifest.Cached = true
+    } else if local.Source == "" || local.State == image.StateDeleted {
+        // Local images can't be fetched from anywhere else
+        // and images in the trash are not served at all
+        return 0, errors.ResourceNotFound(nil)
+    }
+
+    index, err := image.SelectFile(manifest.Files, sel)
+    if err != nil {
+        return 0, err
+    }
+
+    // Fetch the file by index, the source may pick another file with
+    // the same compression
+    body, err := self.getFile(manifest.Source, uuid, index)
+    if err != nil {
+        return 0, err
+    }
+    defer body.Close()
+
+    // Servers that don't know about ?index serve the first file for any
+    // index, only the file with the expected sha1 is passed on
+    if !body.serves(manifest.Files[index].Sha1, index) {
+        err := fmt.Errorf("%s doesn't serve file %d of %s", manifest.Source, index, uuid)
+        return 0, errors.BadGatewayError(err)
+    }
+
+    // Keep writing to the pool even if the client goes away
+    writer := &clientWriter{writer: res}
+    reader := io.TeeReader(body, writer)
+
+    if body.md5 != "" {
+        res.Header().Set("Content-Md5", body.md5)
+    }
+    res.Header().Set("Content-Length", fmt.Sprintf("%d", manifest.Files[index].Size))
+    responder.New(res).SetImageFile(manifest.Files[index].Sha1, manifest.Files[index].Compression)
+    res.WriteHeader(http.StatusOK)
+
+    if local == nil {
+        err = self.pool.Import(manifest, index, reader, "proxy:" + self.upstream)
+    } else {
+        err = self.pool.RestoreFile(uuid, index, reader)
+    }
+
+    if err != nil {
+        self.logger.Errorf("Failed to cache image file %s from %s: %s", uuid, manifest.Source, err)
+    }
+
+    self.evict(uuid)
+
+    return writer.n, nil
+}
+
+type upstreamFile struct {
+    io.ReadCloser
+    md5 string
+    sha1 string
+}
+
+// serves returns true if the upstream file is the one with the given
+// sha1, the first file is trusted if the upstream doesn't say
+func (self *upstreamFile) serves(sha1sum string, index int) bool {
+    if self.sha1 == "" {
+        return index == 0
+    }
+    return self.sha1 == sha1sum
+}
+
+func (self *Proxy) getFile(source, uuid string, index int) (*upstreamFile, errors.Error) {
+    url := fmt.Sprintf("%s/images/%s/file?index=%d", strings.TrimSuffix(source, "/"), uuid, index)
+
+    res, err := self.client.Get(url)
+    if err != nil {
+        return nil, errors.ServiceUnavailableError(err)
+    }
+
+    if res.StatusCode != http.StatusOK {
+        res.Body.Close()
+        err := fmt.Errorf("Unexpected status from %s: %s", source, res.Status)
+        return nil, errors.ServiceUnavailableError(err)
+    }
+
+    return &upstreamFile{res.Body, res.Header.Get("Content-Md5"), res.Header.Get(responder.ImageSha1Header)}, nil
+}
+
+// evict removes the least recently used image files until the cache
+// fits within the max size. The file of keepUuid is never evicted.
+func (self *Proxy) evict(keepUuid string) {
+    if self.maxSize <= 0 {
+        return
+    }
+
+    self.evictMutex.Lock()
+    defer self.evictMutex.Unlock()
+
+    files := self.pool.CachedFiles()
+    sort.Sort(byLastUsed(files))
+
+    var total int64
+    for _, file := range files {
+        total += file.Size
+    }
+
+    for _, file := range files {
+        if total <= self.maxSize {
+            break
+        }
+
+        if file.Uuid == keepUuid {
+            continue
+        }
+
+        if err := self.pool.EvictFile(file.Uuid, file.Sha1); err == nil {
+            total -= file.Size
+        }
+    }
+}
+
+// clientWriter counts the bytes written and ignores write errors
+// so that a disconnected client doesn't abort filling the cache
+type clientWriter struct {
+    writer io.Writer
+    n int64
+    failed bool
+}
+
+func (self *clientWriter) Write(p []byte) (int, error) {
+    if !self.failed {
+        n, err := self.writer.Write(p)
+        self.n += int64(n)
+        self.failed = err != nil
+    }
+    return len(p), nil
+}
+
+type byLastUsed []*image.CachedFile
+
+func (self byLastUsed) Len() int {
+    return len(self)
+}
+
+func (self byLastUsed) Swap(i, j int) {
+    self[i], self[j] = self[j], self[i]
+}
+
+func (self byLastUsed) Less(i, j int) bool {
+    return self[i].LastUsed.Before(self[j].LastUsed)
+}
@@ -0,0 +1,288 @@
+package recompress
+
+import (
+    "io"
+    "fmt"
+    "sync"
+    "time"
+    "context"
+    "os/exec"
+    "io/ioutil"
+    "compress/gzip"
+    "compress/bzip2"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/log"
+)
+
+const (
+    Actor = "recompressor"
+    checkInterval = time.Minute
+)
+
+// Formats lists the compressions variants can be made in
+var Formats = map[string]bool{
+    "gzip": true,
+    "xz": true,
+}
+
+// Recompressor adds variants in other compressions to the image files of
+// activated local images, whose files can no longer be replaced. The
+// variants are added after the uploaded file, so the uploaded file stays
+// the one served by default. Images cached by the proxy are skipped since
+// their files may be evicted.
+type Recompressor struct {
+    pool *image.Pool
+    formats []string
+    failed map[string]bool
+    wake chan struct{}
+    ctx context.Context
+    cancel func()
+    done chan struct{}
+    logger *log.Logger
+    mutex *sync.Mutex
+}
+
+// New starts making variants in the given formats, none disables it
+func New(pool *image.Pool, formats []string, logger *log.Logger) *Recompressor {
+    ctx, cancel := context.WithCancel(context.Background())
+
+    recompressor := &Recompressor{
+        pool: pool,
+        formats: formats,
+        failed: make(map[string]bool),
+        wake: make(chan struct{}, 1),
+        ctx: ctx,
+        cancel: cancel,
+        done: make(chan struct{}),
+        logger: logger,
+        mutex: &sync.Mutex{},
+    }
+
+    go recompressor.run()
+
+    return recompressor
+}
+
+// SetFormats changes the formats variants are made in, existing
+// variants in formats that are no longer wanted are kept
+func (self *Recompressor) SetFormats(formats []string) {
+    self.mutex.Lock()
+    self.formats = formats
+    self.mutex.Unlock()
+
+    select {
+    case self.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Close stops recompressing and waits for a running recompression to be
+// aborted, the partial variant is removed and running commands are killed
+func (self *Recompressor) Close() {
+    self.cancel()
+    <-self.done
+}
+
+func (self *Recompressor) run() {
+    defer close(self.done)
+
+    for {
+        self.recompress()
+
+        select {
+        case <-time.After(checkInterval):
+        case <-self.wake:
+        case <-self.ctx.Done():
+            return
+        }
+    }
+}
+
+func (self *Recompressor) recompress() {
+    self.mutex.Lock()
+    formats := self.formats
+    self.mutex.Unlock()
+
+    if len(formats) == 0 {
+        return
+    }
+
+    for _, m := range self.pool.ListCopies(nil) {
+        if m.Cached || len(m.Files) == 0 {
+            continue
+        }
+
+        if m.State != image.StateActive && m.State != image.StateDisabled {
+            continue
+        }
+
+        for _, format := range formats {
+            if self.ctx.Err() != nil {
+                return
+            }
+
+            if hasCompression(m, format) {
+                continue
+            }
+
+            // Don't retry variants that failed until the next restart
+            original := m.Files[0]
+            key := fmt.Sprintf("%s/%s/%s", m.Uuid, original.Sha1, format)
+            if self.failed[key] {
+                continue
+            }
+
+            err := self.addVariant(m.Uuid, original, format)
+            if err != nil && self.ctx.Err() != nil {
+                return
+            } else if err != nil {
+                self.logger.Errorf("Failed to recompress image %s to %s: %s", m.Uuid, format, err)
+                self.failed[key] = true
+                continue
+            }
+
+            self.logger.Infof("Recompressed image %s to %s", m.Uuid, format)
+        }
+    }
+}
+
+// addVariant decompresses the original image file and writes it to
+// the pool compressed in format
+func (self *Recompressor) addVariant(uuid string, original *image.ImageFile, format string) error {
+    file, _, err := self.pool.GetFile(uuid, image.FileSelector{Compression: original.Compression})
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    return self.writeVariant(uuid, original, format, &ctxReader{self.ctx, file})
+}
+
+func (self *Recompressor) writeVariant(uuid string, original *image.ImageFile, format string, file io.Reader) error {
+    decompressed, err := decompress(self.ctx, file, original.Compression)
+    if err != nil {
+        return err
+    }
+    defer decompressed.Close()
+
+    compressed, err := compress(self.ctx, decompressed, format)
+    if err != nil {
+        return err
+    }
+    defer compressed.Close()
+
+    if err := self.pool.AddVariant(uuid, original.Sha1, format, compressed, Actor); err != nil {
+        return err
+    }
+    return nil
+}
+
+func hasCompression(m *image.Manifest, compression string) bool {
+    for _, file := range m.Files {
+        if file.Compression == compression {
+            return true
+        }
+    }
+    return false
+}
+
+// decompress returns the data of reader with the given compression removed
+func decompress(ctx context.Context, reader io.Reader, compression string) (io.ReadCloser, error) {
+    switch compression {
+    case "none":
+        return ioutil.NopCloser(reader), nil
+    case "gzip":
+        return gzip.NewReader(reader)
+    case "bzip2":
+        return ioutil.NopCloser(bzip2.NewReader(reader)), nil
+    case "xz":
+        return command(ctx, reader, "xz", "--decompress", "--stdout")
+    }
+
+    return nil, fmt.Errorf("Unsupported compression %s", compression)
+}
+
+// compress returns the data of reader compressed in format
+func compress(ctx context.Context, reader io.Reader, format string) (io.ReadCloser, error) {
+    switch format {
+    case "gzip":
+        pr, pw := io.Pipe()
+        go func() {
+            writer := gzip.NewWriter(pw)
+            _, err := io.Copy(writer, reader)
+            if err == nil {
+                err = writer.Close()
+            }
+            pw.CloseWithError(err)
+        }()
+        return pr, nil
+    case "xz":
+        return command(ctx, reader, "xz", "--compress", "--stdout")
+    }
+
+    return nil, fmt.Errorf("Unsupported compression %s", format)
+}
+
+// command runs name with reader as stdin, closing the returned reader
+// waits for the command to exit. The command is killed when ctx is done.
+func command(ctx context.Context, reader io.Reader, name string, args ...string) (io.ReadCloser, error) {
+    cmd := exec.CommandContext(ctx, name, args...)
+    cmd.Stdin = reader
+
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+
+    if err := cmd.Start(); err != nil {
+        return nil, err
+    }
+
+    return &commandReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// commandReader reads the output of a command and fails the read that
+// hits the end of the output if the command failed
+type commandReader struct {
+    io.ReadCloser
+    cmd *exec.Cmd
+    exited bool
+}
+
+func (self *commandReader) Read(p []byte) (int, error) {
+    if self.exited {
+        return 0, io.EOF
+    }
+
+    n, err := self.ReadCloser.Read(p)
+    if err == io.EOF {
+        self.exited = true
+        if err := self.cmd.Wait(); err != nil {
+            return n, fmt.Errorf("%s: %s", self.cmd.Path, err)
+        }
+    }
+    return n, err
+}
+
+func (self *commandReader) Close() error {
+    if !self.exited {
+        self.exited = true
+        self.cmd.Process.Kill()
+        self.cmd.Wait()
+    }
+    return nil
+}
+
+// ctxReader fails reads once ctx is done, so a recompression in progress
+// stops reading the image file
+type ctxReader struct {
+    ctx context.Context
+    reader io.Reader
+}
+
+func (self *ctxReader) Read(p []byte) (int, error) {
+    if err := self.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return self.reader.Read(p)
+}
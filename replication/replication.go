@@ -0,0 +1,477 @@
+package replication
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "context"
+    "strings"
+    "net/http"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "github.com/prasmussen/smartimages/atomicfile"
+    "github.com/prasmussen/smartimages/changefeed"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/log"
+)
+
+const (
+    StateFname = "replication.json"
+    RolePrimary = "primary"
+    RoleSecondary = "secondary"
+
+    pollTimeout = 30
+    retryDelay = 10 * time.Second
+)
+
+// Status is the replication state reported by /ping. Lag is the number of
+// seconds since the oldest change of the primary that is not applied yet.
+type Status struct {
+    Role string `json:"role"`
+    Primary string `json:"primary,omitempty"`
+    Seq uint64 `json:"seq"`
+    PrimarySeq uint64 `json:"primary_seq,omitempty"`
+    Lag float64 `json:"lag"`
+    Error string `json:"error,omitempty"`
+}
+
+// state is persisted so that the secondary continues where it left off
+type state struct {
+    Primary string `json:"primary"`
+    Seq uint64 `json:"seq"`
+    Synced bool `json:"synced"`
+    Promoted bool `json:"promoted"`
+}
+
+// Follower keeps the pool of a secondary in sync with the primary by
+// following its changefeed. Manifests are copied as is and image files
+// are only accepted if their sha1 matches the manifest. After promotion
+// the follower stops and the instance acts as a primary.
+type Follower struct {
+    pool *image.Pool
+    primary string
+    fpath string
+    state state
+    primarySeq uint64
+    caughtUp bool
+    behindSince time.Time
+    lastErr error
+    client *http.Client
+    ctx context.Context
+    cancel func()
+    done chan struct{}
+    promoted chan struct{}
+    logger *log.Logger
+    mutex *sync.Mutex
+}
+
+type changes struct {
+    Seq uint64 `json:"seq"`
+    Changes []*changefeed.Entry `json:"changes"`
+}
+
+// New loads the replication state stored in dataDir and starts following
+// primary unless this instance has been promoted
+func New(pool *image.Pool, primary, dataDir string, logger *log.Logger) (*Follower, error) {
+    ctx, cancel := context.WithCancel(context.Background())
+
+    follower := &Follower{
+        pool: pool,
+        primary: strings.TrimSuffix(primary, "/"),
+        fpath: filepath.Join(dataDir, StateFname),
+        behindSince: time.Now(),
+        client: &http.Client{},
+        ctx: ctx,
+        cancel: cancel,
+        done: make(chan struct{}),
+        promoted: make(chan struct{}),
+        logger: logger,
+        mutex: &sync.Mutex{},
+    }
+
+    if err := follower.load(); err != nil {
+        return nil, err
+    }
+
+    // The cursor is only valid for the primary it was taken from
+    if follower.state.Primary != follower.primary && !follower.state.Promoted {
+        follower.state = state{Primary: follower.primary}
+    }
+
+    if follower.state.Promoted {
+        close(follower.done)
+        close(follower.promoted)
+    } else {
+        go follower.run()
+    }
+
+    return follower, nil
+}
+
+func (self *Follower) load() error {
+    data, err := ioutil.ReadFile(self.fpath)
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    if err := json.Unmarshal(data, &self.state); err != nil {
+        return fmt.Errorf("Failed to parse %s: %s", self.fpath, err)
+    }
+
+    return nil
+}
+
+// save writes the replication state to disk, the caller must hold the lock
+func (self *Follower) save() error {
+    data, err := json.Marshal(self.state)
+    if err != nil {
+        return err
+    }
+
+    return atomicfile.WriteData(self.fpath, data)
+}
+
+// IsSecondary returns true until the instance is promoted,
+// the catalog of a secondary must not be changed by clients
+func (self *Follower) IsSecondary() bool {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return !self.state.Promoted
+}
+
+// Promoted returns a channel which is closed when the instance is promoted
+func (self *Follower) Promoted() <-chan struct{} {
+    return self.promoted
+}
+
+// Status returns the role and replication lag
+func (self *Follower) Status() *Status {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.state.Promoted {
+        return &Status{Role: RolePrimary}
+    }
+
+    status := &Status{
+        Role: RoleSecondary,
+        Primary: self.primary,
+        Seq: self.state.Seq,
+        PrimarySeq: self.primarySeq,
+    }
+
+    if !self.caughtUp {
+        status.Lag = time.Since(self.behindSince).Seconds()
+    }
+
+    if self.lastErr != nil {
+        status.Error = self.lastErr.Error()
+    }
+
+    return status
+}
+
+// Promote stops following the primary and makes this instance a primary,
+// the promotion is persisted and survives a restart
+func (self *Follower) Promote() error {
+    self.cancel()
+    <-self.done
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.state.Promoted {
+        return nil
+    }
+
+    self.state.Promoted = true
+    if err := self.save(); err != nil {
+        self.state.Promoted = false
+        return err
+    }
+    close(self.promoted)
+
+    self.logger.Infof("Promoted to primary, stopped replicating from %s", self.primary)
+    return nil
+}
+
+// Close stops following the primary and waits for a running sync to be aborted
+func (self *Follower) Close() {
+    self.cancel()
+    <-self.done
+}
+
+func (self *Follower) run() {
+    defer close(self.done)
+
+    for self.ctx.Err() == nil {
+        err := self.follow()
+        if err == nil || self.ctx.Err() != nil {
+            continue
+        }
+
+        self.logger.Errorf("Failed to replicate from %s: %s", self.primary, err)
+        self.setError(err)
+
+        select {
+        case <-time.After(retryDelay):
+        case <-self.ctx.Done():
+        }
+    }
+}
+
+// follow applies the changes after the current cursor, a full
+// sync is done if the primary no longer has the changes
+func (self *Follower) follow() error {
+    self.mutex.Lock()
+    seq := self.state.Seq
+    synced := self.state.Synced
+    self.mutex.Unlock()
+
+    if !synced {
+        return self.fullSync()
+    }
+
+    feed, status, err := self.poll(seq)
+    if err != nil {
+        return err
+    }
+
+    if status == http.StatusGone {
+        self.logger.Infof("Changes since %d are no longer available on %s, doing a full sync", seq, self.primary)
+        return self.fullSync()
+    }
+
+    // Lag is counted from the oldest change that is not applied yet
+    var oldest time.Time
+    if len(feed.Changes) > 0 {
+        oldest, _ = time.Parse(time.RFC3339Nano, feed.Changes[0].Time)
+        if oldest.IsZero() {
+            oldest = time.Now()
+        }
+    }
+    self.setPrimarySeq(feed.Seq, oldest)
+
+    for _, entry := range feed.Changes {
+        if err := self.apply(entry.Action, entry.Uuid, entry.Image); err != nil {
+            return fmt.Errorf("Change %d (%s %s): %s", entry.Seq, entry.Action, entry.Uuid, err)
+        }
+
+        if err := self.setSeq(entry.Seq); err != nil {
+            return err
+        }
+    }
+
+    self.setError(nil)
+    return nil
+}
+
+// fullSync copies the whole catalog of the primary and removes the
+// images it doesn't have, the cursor is then set to the primary's latest change
+func (self *Follower) fullSync() error {
+    // Without a cursor the changefeed returns the latest sequence number
+    feed := &changes{}
+    if err := self.getJSON(self.primary + "/changefeed?timeout=0", feed); err != nil {
+        return err
+    }
+
+    self.setPrimarySeq(feed.Seq, time.Now())
+
+    manifests := make([]*image.Manifest, 0)
+    if err := self.getJSON(self.primary + "/images?state=all", &manifests); err != nil {
+        return err
+    }
+
+    // Images in the trash are not included in all
+    deleted := make([]*image.Manifest, 0)
+    if err := self.getJSON(self.primary + "/images?state=deleted", &deleted); err != nil {
+        return err
+    }
+    manifests = append(manifests, deleted...)
+
+    remote := make(map[string]bool)
+    for _, m := range manifests {
+        remote[m.Uuid] = true
+
+        if err := self.apply(image.ActionImport, m.Uuid, m); err != nil {
+            return fmt.Errorf("Image %s: %s", m.Uuid, err)
+        }
+    }
+
+    for _, m := range self.pool.List(nil) {
+        if !remote[m.Uuid] {
+            if err := self.apply(image.ActionPurge, m.Uuid, nil); err != nil {
+                return fmt.Errorf("Image %s: %s", m.Uuid, err)
+            }
+        }
+    }
+
+    // Changes made during the sync are applied again, which is harmless
+    self.mutex.Lock()
+    self.state.Synced = true
+    self.mutex.Unlock()
+
+    if err := self.setSeq(feed.Seq); err != nil {
+        return err
+    }
+
+    self.setError(nil)
+    return nil
+}
+
+// apply makes the local image uuid look like m, a nil manifest means
+// the image was purged. Image files are only downloaded if they changed.
+func (self *Follower) apply(action image.Action, uuid string, m *image.Manifest) error {
+    actor := "replication:" + self.primary
+
+    if m == nil {
+        if _, err := self.pool.Get(uuid); err != nil {
+            return nil
+        }
+
+        if err := self.pool.Purge(uuid, actor); err != nil {
+            return err
+        }
+        return nil
+    }
+
+    missing := self.pool.MissingFiles(m)
+    if len(missing) == 0 {
+        if err := self.pool.Replicate(action, m, 0, nil, actor); err != nil {
+            return err
+        }
+        return nil
+    }
+
+    // The manifest is replaced once the last missing file is written
+    for _, index := range missing {
+        done, err := self.replicateFile(action, m, index, actor)
+        if err != nil {
+            return err
+        }
+
+        // The state still changed on the primary
+        if !done {
+            return self.pool.ReplicateState(action, m, actor)
+        }
+    }
+    return nil
+}
+
+// replicateFile downloads the image file at index from the primary, false
+// is returned if the primary doesn't serve it
+func (self *Follower) replicateFile(action image.Action, m *image.Manifest, index int, actor string) (bool, error) {
+    res, err := self.get(fmt.Sprintf("%s/images/%s/file?index=%d", self.primary, m.Uuid, index))
+    if err != nil {
+        return false, err
+    }
+    defer res.Body.Close()
+
+    // The image may have been deleted on the primary after this change,
+    // files of images in the trash are fetched if they are restored
+    if res.StatusCode == http.StatusNotFound {
+        return false, nil
+    } else if res.StatusCode != http.StatusOK {
+        return false, fmt.Errorf("Unexpected status downloading file: %s", res.Status)
+    }
+
+    if err := self.pool.Replicate(action, m, index, res.Body, actor); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// poll long-polls the changefeed of the primary for changes after seq,
+// the status is returned so that an expired cursor can be detected
+func (self *Follower) poll(seq uint64) (*changes, int, error) {
+    url := fmt.Sprintf("%s/changefeed?timeout=%d&since=%d", self.primary, pollTimeout, seq)
+
+    res, err := self.get(url)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode == http.StatusGone {
+        return nil, res.StatusCode, nil
+    } else if res.StatusCode != http.StatusOK {
+        return nil, res.StatusCode, fmt.Errorf("Unexpected status polling changefeed: %s", res.Status)
+    }
+
+    feed := &changes{}
+    if err := json.NewDecoder(res.Body).Decode(feed); err != nil {
+        return nil, res.StatusCode, err
+    }
+
+    return feed, res.StatusCode, nil
+}
+
+func (self *Follower) getJSON(url string, v interface{}) error {
+    res, err := self.get(url)
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode != http.StatusOK {
+        return fmt.Errorf("Unexpected status from %s: %s", url, res.Status)
+    }
+
+    return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (self *Follower) get(url string) (*http.Response, error) {
+    req, err := http.NewRequest("GET", url, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    return self.client.Do(req.WithContext(self.ctx))
+}
+
+func (self *Follower) setSeq(seq uint64) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.state.Seq = seq
+    if err := self.save(); err != nil {
+        return err
+    }
+
+    if self.state.Seq >= self.primarySeq {
+        self.caughtUp = true
+    }
+    return nil
+}
+
+// setPrimarySeq records the latest sequence number of the primary and
+// the time of the oldest change that is not applied yet, if there is one
+func (self *Follower) setPrimarySeq(seq uint64, oldest time.Time) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if seq > self.primarySeq {
+        self.primarySeq = seq
+    }
+
+    if !oldest.IsZero() {
+        if self.caughtUp {
+            self.caughtUp = false
+            self.behindSince = oldest
+        }
+    } else if self.state.Seq >= self.primarySeq {
+        self.caughtUp = true
+    }
+}
+
+func (self *Follower) setError(err error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.lastErr = err
+}
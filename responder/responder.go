@@ -36,6 +36,17 @@ func (self *Responder) SetContentMd5(md5sum []byte) {
     self.res.Header().Set("Content-Md5", b64)
 }
 
+// ImageSha1Header has the sha1 of the image file served, servers that
+// send it also serve the other files of an image with ?index=N
+const ImageSha1Header = "X-Image-Sha1"
+
+// SetImageFile tells which of the files of an image is served, the
+// compression is part of the file and not a content encoding
+func (self *Responder) SetImageFile(sha1sum, compression string) {
+    self.res.Header().Set(ImageSha1Header, sha1sum)
+    self.res.Header().Set("X-Image-Compression", compression)
+}
+
 func (self *Responder) Error(err errors.Error) {
     self.res.WriteHeader(err.StatusCode())
     self.JSON(err.Data())
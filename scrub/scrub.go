@@ -0,0 +1,245 @@
+package scrub
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "context"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/atomicfile"
+    "github.com/prasmussen/smartimages/log"
+)
+
+const (
+    ReportFname = "scrub.json"
+    Actor = "scrubber"
+)
+
+// Report is the outcome of a scrub, only the failed results are kept
+type Report struct {
+    Started time.Time `json:"started"`
+    Finished time.Time `json:"finished"`
+    Checked int `json:"checked"`
+    Failed []*image.VerifyResult `json:"failed"`
+}
+
+// Scrubber periodically verifies the image files of all images, images
+// with a corrupt or missing file are moved to the failed state. The report
+// of the last scrub is persisted so the schedule survives a restart.
+// A read only scrubber only reports problems and leaves the catalog as is.
+type Scrubber struct {
+    pool *image.Pool
+    fpath string
+    interval time.Duration
+    readOnly bool
+    report *Report
+    running bool
+    wake chan struct{}
+    ctx context.Context
+    cancel func()
+    done chan struct{}
+    logger *log.Logger
+    mutex *sync.Mutex
+}
+
+// New loads the last report stored in dataDir and starts scrubbing
+// every interval seconds, zero disables scheduled scrubs
+func New(pool *image.Pool, dataDir string, interval int, readOnly bool, logger *log.Logger) (*Scrubber, error) {
+    ctx, cancel := context.WithCancel(context.Background())
+
+    scrubber := &Scrubber{
+        pool: pool,
+        fpath: filepath.Join(dataDir, ReportFname),
+        interval: time.Duration(interval) * time.Second,
+        readOnly: readOnly,
+        wake: make(chan struct{}, 1),
+        ctx: ctx,
+        cancel: cancel,
+        done: make(chan struct{}),
+        logger: logger,
+        mutex: &sync.Mutex{},
+    }
+
+    if err := scrubber.load(); err != nil {
+        return nil, err
+    }
+
+    go scrubber.run()
+
+    return scrubber, nil
+}
+
+func (self *Scrubber) load() error {
+    data, err := ioutil.ReadFile(self.fpath)
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    report := &Report{}
+    if err := json.Unmarshal(data, report); err != nil {
+        return fmt.Errorf("Failed to parse %s: %s", self.fpath, err)
+    }
+
+    self.report = report
+    return nil
+}
+
+func (self *Scrubber) save(report *Report) error {
+    data, err := json.Marshal(report)
+    if err != nil {
+        return err
+    }
+
+    return atomicfile.WriteData(self.fpath, data)
+}
+
+// SetInterval changes the number of seconds between scrubs
+func (self *Scrubber) SetInterval(interval int) {
+    self.mutex.Lock()
+    self.interval = time.Duration(interval) * time.Second
+    self.mutex.Unlock()
+
+    select {
+    case self.wake <- struct{}{}:
+    default:
+    }
+}
+
+// SetReadOnly changes whether images that fail verification are moved
+// to the failed state or only reported
+func (self *Scrubber) SetReadOnly(readOnly bool) {
+    self.mutex.Lock()
+    self.readOnly = readOnly
+    self.mutex.Unlock()
+}
+
+// Report returns the report of the last finished scrub or nil if there
+// was none, running is true while a scrub is in progress
+func (self *Scrubber) Report() (*Report, bool) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.report, self.running
+}
+
+// Close stops scrubbing and waits for a running scrub to be aborted
+func (self *Scrubber) Close() {
+    self.cancel()
+    <-self.done
+}
+
+func (self *Scrubber) run() {
+    defer close(self.done)
+
+    for {
+        var timer <-chan time.Time
+        if wait, ok := self.next(); ok {
+            timer = time.After(wait)
+        }
+
+        select {
+        case <-timer:
+            self.scrub()
+        case <-self.wake:
+        case <-self.ctx.Done():
+            return
+        }
+    }
+}
+
+// next returns the time until the next scrub is due,
+// false is returned if scheduled scrubs are disabled
+func (self *Scrubber) next() (time.Duration, bool) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.interval <= 0 {
+        return 0, false
+    }
+
+    if self.report == nil {
+        return 0, true
+    }
+
+    wait := time.Until(self.report.Started.Add(self.interval))
+    if wait < 0 {
+        wait = 0
+    }
+    return wait, true
+}
+
+func (self *Scrubber) scrub() {
+    self.setRunning(true)
+
+    report := &Report{
+        Started: time.Now(),
+        Failed: make([]*image.VerifyResult, 0),
+    }
+
+    manifests := self.pool.List(nil)
+    for _, m := range manifests {
+        // Don't save a partial report, the scrub is redone after a restart
+        if self.ctx.Err() != nil {
+            self.setRunning(false)
+            return
+        }
+
+        result, err := self.verify(m.Uuid)
+        if err != nil {
+            // The image may have been deleted in the meantime
+            continue
+        }
+
+        report.Checked++
+        if !result.Ok {
+            self.logger.Errorf("Image %s failed verification: %s", m.Uuid, result.Problem)
+            report.Failed = append(report.Failed, result)
+        }
+    }
+
+    report.Finished = time.Now()
+
+    if err := self.save(report); err != nil {
+        self.logger.Errorf("Failed to save scrub report: %s", err)
+    }
+
+    self.mutex.Lock()
+    self.report = report
+    self.running = false
+    self.mutex.Unlock()
+}
+
+// verify checks the image files of uuid and moves the image to the failed
+// state if they are corrupt, unless the scrubber is read only
+func (self *Scrubber) verify(uuid string) (*image.VerifyResult, error) {
+    self.mutex.Lock()
+    readOnly := self.readOnly
+    self.mutex.Unlock()
+
+    if readOnly {
+        result, err := self.pool.VerifyFile(uuid)
+        if err != nil {
+            return nil, err
+        }
+        return result, nil
+    }
+
+    result, err := self.pool.Verify(uuid, Actor)
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+func (self *Scrubber) setRunning(running bool) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.running = running
+}
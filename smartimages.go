@@ -1,32 +1,142 @@
 package main
 
 import (
+    "os"
     "fmt"
+    "flag"
+    "strings"
+    "time"
+    "context"
+    "syscall"
+    "os/signal"
+    "path/filepath"
     "net/http"
     "github.com/gorilla/pat"
+    "github.com/prasmussen/smartimages/audit"
+    "github.com/prasmussen/smartimages/changefeed"
     "github.com/prasmussen/smartimages/config"
+    "github.com/prasmussen/smartimages/gc"
     "github.com/prasmussen/smartimages/handler"
     "github.com/prasmussen/smartimages/image"
     "github.com/prasmussen/smartimages/log"
+    "github.com/prasmussen/smartimages/metrics"
+    "github.com/prasmussen/smartimages/mirror"
+    "github.com/prasmussen/smartimages/proxy"
+    "github.com/prasmussen/smartimages/replication"
+    "github.com/prasmussen/smartimages/scrub"
+    "github.com/prasmussen/smartimages/recompress"
+    "github.com/prasmussen/smartimages/trash"
+    "github.com/prasmussen/smartimages/webhook"
 )
 
 func main() {
+    configFname := flag.String("config", config.DefaultConfig, "Path to config file")
+    flag.Parse()
+
     // Load config file
-    cfg, err := config.Load()
+    cfg, err := config.Load(*configFname)
     if err != nil {
         fmt.Println(err)
-        return
+        os.Exit(1)
     }
 
-    // Instantiate logger 
-    logger, err := log.New(cfg.LogFile)
+    // Run command if one was given
+    if flag.NArg() > 0 {
+        os.Exit(runCommand(cfg, flag.Args()))
+    }
+
+    // Instantiate logger
+    logger, err := log.New(cfg.LogOptions())
     if err != nil {
         fmt.Println(err)
-        return
+        os.Exit(1)
+    }
+
+    m := metrics.New()
+
+    // Load image catalog
+    pool, err := image.NewImagePool(cfg.DataDir, m, logger)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+
+    // Record all catalog changes in the audit log
+    auditLog, err := audit.Open(filepath.Join(cfg.DataDir, audit.AuditFname), logger)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    pool.Listen(auditLog.Record)
+
+    // Keep a feed of the latest catalog changes
+    feed, err := changefeed.Open(cfg.DataDir, cfg.ChangefeedRetention, logger)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    pool.Listen(feed.Record)
+
+    // Follow the primary if this instance is a secondary
+    var replica *replication.Follower
+    if cfg.Primary != "" {
+        replica, err = replication.New(pool, cfg.Primary, cfg.DataDir, logger)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+    }
+
+    // Notify webhooks of catalog changes
+    webhooks, err := webhook.New(cfg.DataDir, webhookHooks(cfg, replica), logger)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    pool.Listen(webhooks.Notify)
+
+    // Import images from upstream servers
+    mirrors := mirror.New(pool, mirrorUpstreams(cfg, replica), logger)
+
+    // Verify image files in the background
+    scrubber, err := scrub.New(pool, cfg.DataDir, cfg.ScrubInterval, scrubReadOnly(replica), logger)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+
+    // Collect orphaned files and stale images
+    collector := gc.New(pool, gcOptions(cfg, replica), logger)
+
+    // Purge images from the trash when their retention expires
+    purger := trash.New(pool, trashRetention(cfg, replica), logger)
+
+    // Add variants in other compressions to uploaded image files
+    recompressor := recompress.New(pool, recompressFormats(cfg, replica), logger)
+
+    // Load tls certificates
+    tlsConfig, err := cfg.TLSConfig()
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
     }
 
-    pool := image.NewImagePool(cfg.ImageDir)
-    handlers := handler.New(pool, logger)
+    handlers := handler.New(pool, logger, m, auditLog, feed)
+    handlers.SetScrubber(scrubber)
+    handlers.SetCollector(collector)
+    setOperators(cfg, handlers)
+
+    // Serve images that are not in the pool from an upstream
+    if cfg.ProxyUpstream != "" {
+        handlers.SetProxy(proxy.New(pool, cfg.ProxyUpstream, cfg.CacheSizeBytes(), logger))
+    }
+
+    // Never closed unless there is a secondary to promote
+    var promoted <-chan struct{}
+    if replica != nil {
+        handlers.SetReplica(replica)
+        promoted = replica.Promoted()
+    }
 
     router := pat.New()
     router.Get("/images/{uuid}/file", handlers.GetImageFile())
@@ -37,10 +147,311 @@ func main() {
     router.Post("/images", handlers.CreateImage())
     router.Put("/images/{uuid}/file", handlers.AddImageFile())
     router.Get("/ping", handlers.Ping())
-    http.Handle("/", router)
+    router.Get("/metrics", handlers.Metrics())
+    router.Get("/audit", handlers.Audit())
+    router.Get("/changefeed", handlers.Changefeed())
+    router.Post("/replication", handlers.ReplicationAction())
+    router.Get("/scrub", handlers.Scrub())
+    router.Get("/gc", handlers.GC())
+
+    server := &http.Server{
+        Addr: cfg.Listen,
+        Handler: router,
+        TLSConfig: tlsConfig,
+    }
+
+    // Changefeed streams never finish by themselves
+    server.RegisterOnShutdown(feed.StopStreams)
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+
+    // Reload on hangup, shutdown gracefully on interrupt / terminate
+    // and start mirroring once a secondary has been promoted
+    shutdownDone := make(chan struct{})
+    go func() {
+        for {
+            var sig os.Signal
+            select {
+            case <-promoted:
+                promoted = nil
+                webhooks.SetHooks(webhookHooks(cfg, replica))
+                mirrors.SetUpstreams(mirrorUpstreams(cfg, replica))
+                collector.SetOptions(gcOptions(cfg, replica))
+                purger.SetRetention(trashRetention(cfg, replica))
+                recompressor.SetFormats(recompressFormats(cfg, replica))
+                scrubber.SetReadOnly(scrubReadOnly(replica))
+                continue
+            case sig = <-signals:
+            }
+
+            if sig == syscall.SIGHUP {
+                cfg = reload(*configFname, cfg, logger)
+                setOperators(cfg, handlers)
+                webhooks.SetHooks(webhookHooks(cfg, replica))
+                mirrors.SetUpstreams(mirrorUpstreams(cfg, replica))
+                scrubber.SetInterval(cfg.ScrubInterval)
+                collector.SetOptions(gcOptions(cfg, replica))
+                purger.SetRetention(trashRetention(cfg, replica))
+                recompressor.SetFormats(recompressFormats(cfg, replica))
+                continue
+            }
+
+            signal.Stop(signals)
+            shutdown(server, pool, time.Duration(cfg.ShutdownTimeout) * time.Second)
+            close(shutdownDone)
+            return
+        }
+    }()
+
+    if tlsConfig != nil {
+        fmt.Printf("Listening for https connections on %s\n", cfg.Listen)
+        err = server.ListenAndServeTLS("", "")
+    } else {
+        fmt.Printf("Listening for http connections on %s\n", cfg.Listen)
+        err = server.ListenAndServe()
+    }
+
+    if err != http.ErrServerClosed {
+        fmt.Println(err)
+        logger.Close()
+        os.Exit(1)
+    }
+
+    // Wait for in-flight requests to be drained
+    <-shutdownDone
+    if replica != nil {
+        replica.Close()
+    }
+    scrubber.Close()
+    collector.Close()
+    purger.Close()
+    recompressor.Close()
+    mirrors.Close()
+    webhooks.Close()
+    feed.Close()
+    auditLog.Close()
+    logger.Close()
+}
+
+func reload(configFname string, cfg *config.Config, logger *log.Logger) *config.Config {
+    fmt.Println("Reloading config")
+
+    newCfg, ignored, err := cfg.Reload(configFname)
+    if err != nil {
+        fmt.Printf("Failed to reload config, keeping the current one: %s\n", err)
+        newCfg = cfg
+    } else if len(ignored) > 0 {
+        fmt.Printf("Restart required to apply changes to: %s\n", strings.Join(ignored, ", "))
+    }
+
+    // Always reopen the log file so that log rotation works
+    if err := logger.Reopen(newCfg.LogOptions()); err != nil {
+        fmt.Printf("Failed to reopen log file: %s\n", err)
+    }
+
+    return newCfg
+}
+
+func setOperators(cfg *config.Config, handlers *handler.Handler) {
+    // Operators are identified by their client certificate
+    if cfg.ClientCA == "" {
+        return
+    }
+
+    // Never fall back to allowing anyone when operators are required
+    operators := cfg.Operators
+    if operators == nil {
+        operators = map[string]string{}
+    }
+    handlers.SetOperators(operators)
+}
+
+// webhookHooks returns the webhooks to notify, a secondary replays the
+// changes of the primary which has already delivered them
+func webhookHooks(cfg *config.Config, replica *replication.Follower) []webhook.Hook {
+    if replica != nil && replica.IsSecondary() {
+        return nil
+    }
+    return cfg.Webhooks
+}
+
+// mirrorUpstreams returns the upstreams to mirror, a secondary gets
+// its images from the primary and doesn't mirror until it is promoted
+func mirrorUpstreams(cfg *config.Config, replica *replication.Follower) []mirror.Upstream {
+    if replica != nil && replica.IsSecondary() {
+        return nil
+    }
+    return cfg.Mirrors
+}
+
+// gcOptions returns the options for the garbage collection, stale images
+// of a secondary are left for the primary to delete until it is promoted
+func gcOptions(cfg *config.Config, replica *replication.Follower) gc.Options {
+    opts := cfg.GCOptions()
+    if replica != nil && replica.IsSecondary() {
+        opts.MaxAge = 0
+    }
+    return opts
+}
+
+// trashRetention returns the trash retention, a secondary keeps images
+// in the trash until the primary purges them or it is promoted
+func trashRetention(cfg *config.Config, replica *replication.Follower) int {
+    if replica != nil && replica.IsSecondary() {
+        return 0
+    }
+    return cfg.TrashRetention
+}
+
+// recompressFormats returns the compressions to add variants in, a
+// secondary replicates the variants made by the primary
+func recompressFormats(cfg *config.Config, replica *replication.Follower) []string {
+    if replica != nil && replica.IsSecondary() {
+        return nil
+    }
+    return cfg.Recompress
+}
+
+// scrubReadOnly returns true if the scrubber should only report problems,
+// a secondary leaves moving images to the failed state to the primary
+func scrubReadOnly(replica *replication.Follower) bool {
+    return replica != nil && replica.IsSecondary()
+}
+
+func shutdown(server *http.Server, pool *image.Pool, timeout time.Duration) {
+    fmt.Printf("Shutting down, waiting up to %s for requests to finish\n", timeout)
+
+    // Stop accepting new connections and wait for in-flight requests
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    if err := server.Shutdown(ctx); err == nil {
+        return
+    }
+
+    // Timeout expired, close remaining connections and
+    // remove the partial files of incomplete uploads
+    fmt.Println("Shutdown timeout expired, aborting remaining requests")
+    server.Close()
+    pool.AbortUploads()
+}
+
+func runCommand(cfg *config.Config, args []string) int {
+    switch {
+    case len(args) == 2 && args[0] == "config" && args[1] == "check":
+        if err := cfg.Check(); err != nil {
+            fmt.Println(err)
+            return 1
+        }
+        fmt.Println("Config OK")
+        return 0
+    }
+
+    if len(args) > 0 && args[0] == "verify" {
+        return verifyCommand(cfg, args[1:])
+    }
+
+    if len(args) == 1 && args[0] == "gc" {
+        return gcCommand(cfg, false)
+    }
+
+    if len(args) == 2 && args[0] == "gc" && args[1] == "delete" {
+        return gcCommand(cfg, true)
+    }
+
+    fmt.Printf("Unknown command: %v\n", args)
+    fmt.Println("Usage: smartimages [-config <file>] [config check | verify [uuid ...] | gc [delete]]")
+    return 2
+}
+
+// verifyCommand verifies the image files of the given images, or all
+// images if none are given. The catalog is opened read only so it is
+// safe to run while the server is running.
+func verifyCommand(cfg *config.Config, uuids []string) int {
+    pool, err := image.OpenImagePool(cfg.DataDir, metrics.New(), nil)
+    if err != nil {
+        fmt.Println(err)
+        return 1
+    }
+
+    if len(uuids) == 0 {
+        for _, m := range pool.List(nil) {
+            uuids = append(uuids, m.Uuid)
+        }
+    }
+
+    failed := 0
+    for _, uuid := range uuids {
+        result, err := pool.VerifyFile(uuid)
+        if err != nil {
+            fmt.Printf("%s: %s\n", uuid, err)
+            failed++
+        } else if !result.Ok {
+            fmt.Printf("%s: %s\n", uuid, result.Problem)
+            failed++
+        } else {
+            fmt.Printf("%s: OK\n", uuid)
+        }
+    }
+
+    fmt.Printf("Verified %d images, %d failed\n", len(uuids), failed)
+    if failed > 0 {
+        return 1
+    }
+    return 0
+}
+
+// gcCommand reports the garbage in the data directory and removes the
+// orphaned and temp files if remove is set. Stale images are only
+// reported, deleting them while the server is running would make the
+// catalogs of the command and the server diverge. Files are only removed
+// while the server is stopped, it may start using them at any time.
+func gcCommand(cfg *config.Config, remove bool) int {
+    if remove {
+        lockFile, err := image.LockDataDir(cfg.DataDir)
+        if err != nil {
+            fmt.Printf("%s, stop the server before removing garbage\n", err)
+            return 1
+        }
+        defer lockFile.Close()
+    }
+
+    pool, err := image.OpenImagePool(cfg.DataDir, metrics.New(), nil)
+    if err != nil {
+        fmt.Println(err)
+        return 1
+    }
+
+    report, err := pool.GC(image.GCOptions{
+        MaxAge: time.Duration(cfg.GCMaxAge) * time.Second,
+        RemoveFiles: remove,
+    })
+    if err != nil {
+        fmt.Println(err)
+        return 1
+    }
+
+    for _, fname := range report.OrphanedFiles {
+        fmt.Printf("Orphaned file: %s\n", fname)
+    }
+
+    for _, fname := range report.TempFiles {
+        fmt.Printf("Temp file: %s\n", fname)
+    }
+
+    for _, uuid := range report.StaleImages {
+        fmt.Printf("Stale image: %s\n", uuid)
+    }
+
+    verb := "Found"
+    if remove {
+        verb = "Removed"
+    }
+    fmt.Printf("%s %d orphaned files and %d temp files (%d bytes)\n", verb, len(report.OrphanedFiles), len(report.TempFiles), report.Bytes)
 
-    fmt.Printf("Listening for http connections on %s\n", cfg.Listen)
-    if err := http.ListenAndServe(cfg.Listen, nil); err != nil {
-       fmt.Println(err) 
+    if len(report.StaleImages) > 0 {
+        fmt.Printf("Found %d stale images, delete them with DELETE /images/<uuid> or enable gcdelete\n", len(report.StaleImages))
     }
+    return 0
 }
@@ -0,0 +1,82 @@
+package trash
+
+import (
+    "sync"
+    "time"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/log"
+)
+
+const (
+    Actor = "trash"
+    checkInterval = time.Minute
+)
+
+// Purger permanently removes the images that have been in the trash for
+// longer than the retention. A zero retention keeps them forever.
+type Purger struct {
+    pool *image.Pool
+    retention time.Duration
+    quit chan struct{}
+    done chan struct{}
+    logger *log.Logger
+    mutex *sync.Mutex
+}
+
+// New starts purging images deleted more than retention seconds ago
+func New(pool *image.Pool, retention int, logger *log.Logger) *Purger {
+    purger := &Purger{
+        pool: pool,
+        retention: time.Duration(retention) * time.Second,
+        logger: logger,
+        quit: make(chan struct{}),
+        done: make(chan struct{}),
+        mutex: &sync.Mutex{},
+    }
+
+    go purger.run()
+
+    return purger
+}
+
+// SetRetention changes the number of seconds images are kept in the trash
+func (self *Purger) SetRetention(retention int) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.retention = time.Duration(retention) * time.Second
+}
+
+// Close stops purging and waits for a running purge to finish
+func (self *Purger) Close() {
+    close(self.quit)
+    <-self.done
+}
+
+func (self *Purger) run() {
+    defer close(self.done)
+
+    for {
+        self.purge()
+
+        select {
+        case <-time.After(checkInterval):
+        case <-self.quit:
+            return
+        }
+    }
+}
+
+func (self *Purger) purge() {
+    self.mutex.Lock()
+    retention := self.retention
+    self.mutex.Unlock()
+
+    if retention <= 0 {
+        return
+    }
+
+    for _, uuid := range self.pool.PurgeExpired(retention, Actor) {
+        self.logger.Infof("Purged image %s from the trash", uuid)
+    }
+}
@@ -0,0 +1,461 @@
+package webhook
+
+import (
+    "os"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "bytes"
+    "context"
+    "net/http"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "encoding/hex"
+    "crypto/hmac"
+    "crypto/sha256"
+    "code.google.com/p/go-uuid/uuid"
+    "github.com/prasmussen/smartimages/image"
+    "github.com/prasmussen/smartimages/atomicfile"
+    "github.com/prasmussen/smartimages/log"
+)
+
+const (
+    QueueDirName = "webhooks"
+    MaxAttempts = 12
+    MaxBackoff = time.Hour
+    RequestTimeout = 30 * time.Second
+
+    EventHeader = "X-Smartimages-Event"
+    DeliveryHeader = "X-Smartimages-Delivery"
+    SignatureHeader = "X-Smartimages-Signature"
+)
+
+// Hook is a configured webhook. Events is a list of image actions to
+// deliver, all actions are delivered if it is empty. If Secret is set the
+// payload is signed with hmac-sha256 and the hex encoded signature is sent
+// in the X-Smartimages-Signature header as sha256=<signature>.
+type Hook struct {
+    Url string
+    Secret string
+    Events []string
+}
+
+func (self *Hook) wants(action image.Action) bool {
+    if len(self.Events) == 0 {
+        return true
+    }
+
+    for _, event := range self.Events {
+        if event == string(action) {
+            return true
+        }
+    }
+    return false
+}
+
+type Payload struct {
+    Event image.Action `json:"event"`
+    Uuid string `json:"uuid"`
+    Actor string `json:"actor"`
+    Time string `json:"time"`
+    Image *image.Manifest `json:"image"`
+}
+
+// Delivery is a pending delivery of a payload to a webhook url,
+// each delivery is stored in its own file in the queue directory
+type Delivery struct {
+    Id string `json:"id"`
+    Url string `json:"url"`
+    Event image.Action `json:"event"`
+    Payload json.RawMessage `json:"payload"`
+    Created time.Time `json:"created"`
+    Attempts int `json:"attempts"`
+    NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// Dispatcher delivers the queued deliveries with one worker per url, so a
+// slow or unreachable webhook doesn't hold up the others. A worker runs
+// while there are deliveries to its url.
+type Dispatcher struct {
+    dir string
+    hooks []Hook
+    pending []*Delivery
+    client *http.Client
+    workers map[string]chan struct{}
+    ctx context.Context
+    cancel func()
+    wg *sync.WaitGroup
+    logger *log.Logger
+    mutex *sync.Mutex
+}
+
+// New loads the deliveries queued in dataDir and starts delivering them
+func New(dataDir string, hooks []Hook, logger *log.Logger) (*Dispatcher, error) {
+    dir := filepath.Join(dataDir, QueueDirName)
+
+    if err := os.MkdirAll(dir, 0775); err != nil {
+        return nil, err
+    }
+
+    pending, err := loadDeliveries(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    dispatcher := &Dispatcher{
+        dir: dir,
+        hooks: hooks,
+        pending: pending,
+        client: &http.Client{Timeout: RequestTimeout},
+        workers: make(map[string]chan struct{}),
+        ctx: ctx,
+        cancel: cancel,
+        wg: &sync.WaitGroup{},
+        logger: logger,
+        mutex: &sync.Mutex{},
+    }
+
+    dispatcher.mutex.Lock()
+    for _, delivery := range pending {
+        dispatcher.wakeWorker(delivery.Url)
+    }
+    dispatcher.mutex.Unlock()
+
+    return dispatcher, nil
+}
+
+func loadDeliveries(dir string) ([]*Delivery, error) {
+    fnames, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil {
+        return nil, err
+    }
+
+    deliveries := make([]*Delivery, 0)
+
+    for _, fname := range fnames {
+        data, err := ioutil.ReadFile(fname)
+        if err != nil {
+            return nil, err
+        }
+
+        delivery := &Delivery{}
+        if err := json.Unmarshal(data, delivery); err != nil {
+            return nil, fmt.Errorf("Failed to parse %s: %s", fname, err)
+        }
+        deliveries = append(deliveries, delivery)
+    }
+
+    // Deliver in the order the changes happened
+    sort.Sort(byCreated(deliveries))
+
+    return deliveries, nil
+}
+
+// SetHooks replaces the configured webhooks. Queued deliveries to urls
+// that are no longer configured are dropped when they are due.
+func (self *Dispatcher) SetHooks(hooks []Hook) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.hooks = hooks
+}
+
+// Notify is an image.Listener which queues a delivery
+// for every webhook that wants the change
+func (self *Dispatcher) Notify(change *image.Change) {
+    manifest := change.After
+    if manifest == nil {
+        manifest = change.Before
+    }
+
+    payload, err := json.Marshal(&Payload{
+        Event: change.Action,
+        Uuid: change.Uuid,
+        Actor: change.Actor,
+        Time: change.Time.UTC().Format(time.RFC3339Nano),
+        Image: manifest,
+    })
+    if err != nil {
+        self.logger.Errorf("Failed to create webhook payload for %s %s: %s", change.Action, change.Uuid, err)
+        return
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    for _, hook := range self.hooks {
+        if !hook.wants(change.Action) {
+            continue
+        }
+
+        delivery := &Delivery{
+            Id: uuid.NewRandom().String(),
+            Url: hook.Url,
+            Event: change.Action,
+            Payload: payload,
+            Created: change.Time,
+            NextAttempt: change.Time,
+        }
+
+        // Persist delivery before it is attempted so it survives a restart
+        if err := self.save(delivery); err != nil {
+            self.logger.Errorf("Failed to queue webhook delivery to %s: %s", hook.Url, err)
+            continue
+        }
+        self.pending = append(self.pending, delivery)
+        self.wakeWorker(delivery.Url)
+    }
+}
+
+// Close stops delivering and aborts the requests in flight,
+// queued deliveries are kept on disk
+func (self *Dispatcher) Close() {
+    self.mutex.Lock()
+    self.cancel()
+    self.mutex.Unlock()
+
+    self.wg.Wait()
+}
+
+// wakeWorker wakes up the worker delivering to url and starts one if
+// there is none, the caller must hold the lock
+func (self *Dispatcher) wakeWorker(url string) {
+    if self.ctx.Err() != nil {
+        return
+    }
+
+    wake, ok := self.workers[url]
+    if !ok {
+        wake = make(chan struct{}, 1)
+        self.workers[url] = wake
+
+        self.wg.Add(1)
+        go self.run(url, wake)
+    }
+
+    // Wake up the worker without blocking
+    select {
+    case wake <- struct{}{}:
+    default:
+    }
+}
+
+// run delivers to url until there are no deliveries to it left
+func (self *Dispatcher) run(url string, wake chan struct{}) {
+    defer self.wg.Done()
+
+    for {
+        wait, ok := self.deliverDue(url)
+        if !ok {
+            return
+        }
+
+        select {
+        case <-wake:
+        case <-time.After(wait):
+        case <-self.ctx.Done():
+            return
+        }
+    }
+}
+
+// deliverDue attempts the deliveries to url that are due and returns the
+// time until the next one is due. False is returned once there are no
+// deliveries to url left, the worker is removed at the same time so a new
+// one is started for the next delivery.
+func (self *Dispatcher) deliverDue(url string) (time.Duration, bool) {
+    for _, delivery := range self.due(url) {
+        if self.ctx.Err() != nil {
+            return 0, false
+        }
+
+        self.attempt(delivery)
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    var next time.Time
+    for _, delivery := range self.pending {
+        if delivery.Url != url {
+            continue
+        }
+        if next.IsZero() || delivery.NextAttempt.Before(next) {
+            next = delivery.NextAttempt
+        }
+    }
+
+    if next.IsZero() {
+        delete(self.workers, url)
+        return 0, false
+    }
+
+    // Don't spin if the next delivery is already due
+    if wait := time.Until(next); wait > 0 {
+        return wait, true
+    }
+    return time.Millisecond, true
+}
+
+func (self *Dispatcher) due(url string) []*Delivery {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    now := time.Now()
+    deliveries := make([]*Delivery, 0)
+
+    for _, delivery := range self.pending {
+        if delivery.Url == url && !delivery.NextAttempt.After(now) {
+            deliveries = append(deliveries, delivery)
+        }
+    }
+
+    return deliveries
+}
+
+func (self *Dispatcher) attempt(delivery *Delivery) {
+    hook, ok := self.hook(delivery.Url)
+    if !ok {
+        self.logger.Errorf("Dropping webhook delivery %s, %s is no longer configured", delivery.Id, delivery.Url)
+        self.remove(delivery)
+        return
+    }
+
+    err := self.send(hook, delivery)
+    if err == nil {
+        self.remove(delivery)
+        return
+    }
+
+    // Attempts aborted by Close don't count
+    if self.ctx.Err() != nil {
+        return
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    delivery.Attempts++
+    if delivery.Attempts >= MaxAttempts {
+        self.logger.Errorf("Giving up webhook delivery %s to %s after %d attempts: %s", delivery.Id, delivery.Url, delivery.Attempts, err)
+        self.removeLocked(delivery)
+        return
+    }
+
+    delivery.NextAttempt = time.Now().Add(backoff(delivery.Attempts))
+    if err := self.save(delivery); err != nil {
+        self.logger.Errorf("Failed to update webhook delivery %s: %s", delivery.Id, err)
+    }
+}
+
+func (self *Dispatcher) hook(url string) (Hook, bool) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    for _, hook := range self.hooks {
+        if hook.Url == url {
+            return hook, true
+        }
+    }
+    return Hook{}, false
+}
+
+func (self *Dispatcher) send(hook Hook, delivery *Delivery) error {
+    req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(delivery.Payload))
+    if err != nil {
+        return err
+    }
+    req = req.WithContext(self.ctx)
+
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(EventHeader, string(delivery.Event))
+    req.Header.Set(DeliveryHeader, delivery.Id)
+
+    if hook.Secret != "" {
+        req.Header.Set(SignatureHeader, "sha256=" + Sign(hook.Secret, delivery.Payload))
+    }
+
+    res, err := self.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode < 200 || res.StatusCode > 299 {
+        return fmt.Errorf("Unexpected status: %s", res.Status)
+    }
+
+    return nil
+}
+
+func (self *Dispatcher) remove(delivery *Delivery) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.removeLocked(delivery)
+}
+
+func (self *Dispatcher) removeLocked(delivery *Delivery) {
+    pending := make([]*Delivery, 0, len(self.pending))
+    for _, d := range self.pending {
+        if d != delivery {
+            pending = append(pending, d)
+        }
+    }
+    self.pending = pending
+
+    os.Remove(self.fpath(delivery))
+}
+
+// save writes the delivery to the queue directory, the caller must hold the lock
+func (self *Dispatcher) save(delivery *Delivery) error {
+    data, err := json.Marshal(delivery)
+    if err != nil {
+        return err
+    }
+
+    return atomicfile.WriteData(self.fpath(delivery), data)
+}
+
+func (self *Dispatcher) fpath(delivery *Delivery) string {
+    return filepath.Join(self.dir, delivery.Id + ".json")
+}
+
+// Sign returns the hex encoded hmac-sha256 of payload
+func Sign(secret string, payload []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(payload)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the delay before the next attempt, doubling
+// for each failed attempt starting at 10 seconds
+func backoff(attempts int) time.Duration {
+    delay := 10 * time.Second
+    for i := 1; i < attempts && delay < MaxBackoff; i++ {
+        delay *= 2
+    }
+
+    if delay > MaxBackoff {
+        return MaxBackoff
+    }
+    return delay
+}
+
+type byCreated []*Delivery
+
+func (self byCreated) Len() int {
+    return len(self)
+}
+
+func (self byCreated) Swap(i, j int) {
+    self[i], self[j] = self[j], self[i]
+}
+
+func (self byCreated) Less(i, j int) bool {
+    return self[i].Created.Before(self[j].Created)
+}